@@ -0,0 +1,109 @@
+// ADD-PATH (RFC 7911) path IDs. BGP4MP and TABLE_DUMP_V2 records
+// carry them with the subtypes of RFC 8050, which protoparse doesn't
+// know, so they are kept next to the parsed messages.
+
+package gobgpdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	"github.com/CSUNetSec/protoparse/protocol/bgp"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+)
+
+// The path ID of each prefix of an update. The same prefix may be in
+// an update more than once with different path IDs, so prefixes are
+// told apart by their wrapper rather than their value.
+type pathIDs map[*pbcom.PrefixWrapper]uint32
+
+// parseBGP4MP wraps ADD-PATH updates with the path IDs of their
+// prefixes, much like indexedRib wraps RIB entries
+type addPathUpdate struct {
+	pp.BGPUpdater
+	ids pathIDs
+}
+
+// Written like protoparse's update, with the path ID of each prefix
+func (ap *addPathUpdate) String() string {
+	update := ap.GetUpdate()
+	ret := ""
+	if update.WithdrawnRoutes != nil && len(update.WithdrawnRoutes.Prefixes) != 0 {
+		ret += fmt.Sprintf(" Withdrawn Routes (%d):\n", len(update.WithdrawnRoutes.Prefixes))
+		for _, wr := range update.WithdrawnRoutes.Prefixes {
+			ret += fmt.Sprintf("%s/%d path ID %d\n", net.IP(util.GetIP(wr.GetPrefix())), wr.Mask, ap.ids[wr])
+		}
+	}
+	if update.AdvertisedRoutes != nil && len(update.AdvertisedRoutes.Prefixes) != 0 {
+		ret += fmt.Sprintf(" Advertised Routes (%d):\n", len(update.AdvertisedRoutes.Prefixes))
+		for _, ar := range update.AdvertisedRoutes.Prefixes {
+			ret += fmt.Sprintf("%s/%d path ID %d\n", net.IP(util.GetIP(ar.GetPrefix())), ar.Mask, ap.ids[ar])
+		}
+	}
+	return ret + bgp.AttrToString(update.Attrs)
+}
+
+type addPathPrefixJSON struct {
+	*bgp.PrefixWrapper
+	PathID uint32 `json:"path_id"`
+}
+
+// Marshalled like protoparse's update, with a path_id next to the
+// prefix and mask of every route
+func (ap *addPathUpdate) MarshalJSON() ([]byte, error) {
+	update := ap.GetUpdate()
+	out := struct {
+		AdvertisedRoutes []addPathPrefixJSON `json:"advertised_routes,omitempty"`
+		WithdrawnRoutes  []addPathPrefixJSON `json:"withdrawn_routes,omitempty"`
+		Attrs            *bgp.AttrsWrapper   `json:"attrs,omitempty"`
+	}{}
+	if update.AdvertisedRoutes != nil {
+		for _, pref := range update.AdvertisedRoutes.Prefixes {
+			out.AdvertisedRoutes = append(out.AdvertisedRoutes, addPathPrefixJSON{bgp.NewPrefixWrapper(pref), ap.ids[pref]})
+		}
+	}
+	if update.WithdrawnRoutes != nil {
+		for _, pref := range update.WithdrawnRoutes.Prefixes {
+			out.WithdrawnRoutes = append(out.WithdrawnRoutes, addPathPrefixJSON{bgp.NewPrefixWrapper(pref), ap.ids[pref]})
+		}
+	}
+	if update.Attrs != nil {
+		out.Attrs = bgp.NewAttrsWrapper(update.Attrs)
+	}
+	return json.Marshal(out)
+}
+
+// Returns the path IDs of the prefixes that getMsgPrefixes returns
+// for the same location, in the same order. Returns nil if the
+// message is not an ADD-PATH message.
+func getMsgPathIDs(mbs *mrt.MrtBufferStack, loc int) []uint32 {
+	if ir, ok := mbs.Ribbuf.(*indexedRib); ok {
+		if id, ok := ir.pathID(); ok && loc != filter.WdrPrefix {
+			return []uint32{id}
+		}
+		return nil
+	}
+
+	ap, ok := mbs.Bgpupbuf.(*addPathUpdate)
+	if !ok || ap.GetUpdate() == nil {
+		return nil
+	}
+	update := ap.GetUpdate()
+	var ids []uint32
+	if loc != filter.WdrPrefix && update.AdvertisedRoutes != nil {
+		for _, pref := range update.AdvertisedRoutes.Prefixes {
+			ids = append(ids, ap.ids[pref])
+		}
+	}
+	if loc != filter.AdvPrefix && update.WithdrawnRoutes != nil {
+		for _, pref := range update.WithdrawnRoutes.Prefixes {
+			ids = append(ids, ap.ids[pref])
+		}
+	}
+	return ids
+}
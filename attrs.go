@@ -0,0 +1,350 @@
+// Access to BGP path attributes. protoparse parses most attributes,
+// but skips over the contents of some (like large communities), so
+// those are read from the raw path attributes of the message.
+
+package gobgpdump
+
+import (
+	"encoding/binary"
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+const (
+	attrCommunity      = 8
+	attrLargeCommunity = 32
+)
+
+// A standard community, AS:value
+type community [2]uint32
+
+// A large community, global admin:local data 1:local data 2
+type largeCommunity [3]uint32
+
+// Returns the parsed attributes of a message. Updates have one set
+// of attributes, RIB messages have one for each entry, which may be
+// nil if the entry has none.
+func getAttrs(mbs *mrt.MrtBufferStack) []*pbbgp.BGPUpdate_Attributes {
+	if mbs.IsRibStack() {
+		ribh, ok := mbs.Ribbuf.(pp.RIBHeaderer)
+		if !ok || ribh.GetHeader() == nil {
+			return nil
+		}
+		var attrs []*pbbgp.BGPUpdate_Attributes
+		for _, ent := range ribh.GetHeader().RouteEntry {
+			attrs = append(attrs, ent.Attrs)
+		}
+		return attrs
+	}
+
+	upd, ok := mbs.Bgpupbuf.(pp.BGPUpdater)
+	if !ok || upd.GetUpdate() == nil || upd.GetUpdate().Attrs == nil {
+		return nil
+	}
+	return []*pbbgp.BGPUpdate_Attributes{upd.GetUpdate().Attrs}
+}
+
+// Returns the AS path of each set of attributes in a message, in the
+// same order as getAttrs. Segments are flattened into one list like
+// mrt.GetASPath does, but RIB entries are kept apart.
+func getASPaths(mbs *mrt.MrtBufferStack) [][]uint32 {
+	var paths [][]uint32
+	for _, attrs := range getAttrs(mbs) {
+		if attrs == nil {
+			continue
+		}
+		paths = append(paths, flattenASPath(attrs))
+	}
+	return paths
+}
+
+func flattenASPath(attrs *pbbgp.BGPUpdate_Attributes) []uint32 {
+	var path []uint32
+	for _, seg := range attrs.ASPath {
+		if len(seg.ASSeq) > 0 {
+			path = append(path, seg.ASSeq...)
+		} else if len(seg.ASSet) > 0 {
+			path = append(path, seg.ASSet...)
+		}
+	}
+	return path
+}
+
+// Returns the standard communities in a set of attributes
+func getCommunities(attrs *pbbgp.BGPUpdate_Attributes) []community {
+	if attrs == nil || attrs.Communities == nil {
+		return nil
+	}
+	var comms []community
+	for _, com := range attrs.Communities.Communities {
+		// Each community is described in 4 bytes
+		for i := 0; i+4 <= len(com.Community); i += 4 {
+			comms = append(comms, community{
+				uint32(binary.BigEndian.Uint16(com.Community[i : i+2])),
+				uint32(binary.BigEndian.Uint16(com.Community[i+2 : i+4])),
+			})
+		}
+	}
+	return comms
+}
+
+// Returns the large communities in a raw path attribute block
+func getLargeCommunities(block []byte) []largeCommunity {
+	var lcomms []largeCommunity
+	for _, val := range findRawAttrs(block, attrLargeCommunity) {
+		// Each large community is described in 12 bytes
+		for i := 0; i+12 <= len(val); i += 12 {
+			lcomms = append(lcomms, largeCommunity{
+				binary.BigEndian.Uint32(val[i : i+4]),
+				binary.BigEndian.Uint32(val[i+4 : i+8]),
+				binary.BigEndian.Uint32(val[i+8 : i+12]),
+			})
+		}
+	}
+	return lcomms
+}
+
+// Returns the values of every attribute with the given type code
+// in a raw path attribute block
+func findRawAttrs(block []byte, code uint8) [][]byte {
+	var vals [][]byte
+	walkRawAttrs(block, func(typ uint8, val, _ []byte) {
+		if typ == code {
+			vals = append(vals, val)
+		}
+	})
+	return vals
+}
+
+// Calls fn with the type code, the value and the whole of each
+// attribute in a raw path attribute block. Walking stops at an
+// attribute that runs past the end of the block
+func walkRawAttrs(block []byte, fn func(code uint8, val, attr []byte)) {
+	for len(block) >= 3 {
+		flags, typ := block[0], block[1]
+		var alen, hlen int
+		if flags&0x10 != 0 { // extended length
+			if len(block) < 4 {
+				break
+			}
+			alen, hlen = int(binary.BigEndian.Uint16(block[2:4])), 4
+		} else {
+			alen, hlen = int(block[2]), 3
+		}
+		if hlen+alen > len(block) {
+			break
+		}
+		fn(typ, block[hlen:hlen+alen], block[:hlen+alen])
+		block = block[hlen+alen:]
+	}
+}
+
+// Returns the raw path attribute blocks of a message, in the same
+// order as getAttrs returns the parsed ones
+func getRawAttrBlocks(mbs *mrt.MrtBufferStack) [][]byte {
+	raw := mbs.GetRawMessage()
+	if len(raw) < mrt.MRT_HEADER_LEN {
+		return nil
+	}
+	mrtType := binary.BigEndian.Uint16(raw[4:6])
+	subtype := binary.BigEndian.Uint16(raw[6:8])
+	body := raw[mrt.MRT_HEADER_LEN:]
+
+	switch mrtType {
+	case mrt.BGP4MP, mrt.BGP4MP_ET:
+		if _, attrs, _, ok := splitUpdate(bgp4mpMessage(raw)); ok {
+			return [][]byte{attrs}
+		}
+	case mrt.TABLE_DUMP_V2:
+		blocks := ribAttrBlocks(body, subtype)
+		// A RIB message split by splitRib has only one of them
+		if ir, ok := mbs.Ribbuf.(*indexedRib); ok && ir.entry != nil {
+			if ir.pos >= len(blocks) {
+				return nil
+			}
+			return blocks[ir.pos : ir.pos+1]
+		}
+		return blocks
+	case mrt.TABLE_DUMP:
+		if rec, err := readTableDump(body, subtype); err == nil {
+			return [][]byte{rec.attrs}
+		}
+	}
+	return nil
+}
+
+// Returns the body of a raw MRT record, cut to the length in its
+// header. ok is false if the record is shorter than that.
+func mrtBody(raw []byte) (body []byte, ok bool) {
+	if len(raw) < mrt.MRT_HEADER_LEN {
+		return nil, false
+	}
+	body = raw[mrt.MRT_HEADER_LEN:]
+	mrtLen := int(binary.BigEndian.Uint32(raw[8:12]))
+	if mrtLen > len(body) {
+		return nil, false
+	}
+	return body[:mrtLen], true
+}
+
+// Returns the BGP4MP part of a raw BGP4MP record, after the MRT
+// header and the microseconds of BGP4MP_ET, and whether its AS
+// numbers are 4 bytes. ok is false for other records, unknown
+// subtypes, and records too short for their BGP4MP header.
+func bgp4mpBody(raw []byte) (body []byte, as4 bool, ok bool) {
+	if body, ok = mrtBody(raw); !ok {
+		return nil, false, false
+	}
+	mrtType := binary.BigEndian.Uint16(raw[4:6])
+	subtype := binary.BigEndian.Uint16(raw[6:8])
+	switch mrtType {
+	case mrt.BGP4MP:
+	case mrt.BGP4MP_ET:
+		if len(body) < 4 {
+			return nil, false, false
+		}
+		body = body[4:] // microsecond timestamp
+	default:
+		return nil, false, false
+	}
+
+	if as4, ok = bgp4mpAS4(subtype); !ok {
+		return nil, false, false
+	}
+	if len(body) < bgp4mpHeaderLen(body, as4) {
+		return nil, false, false
+	}
+	return body, as4, true
+}
+
+// Returns whether the ASes of a BGP4MP subtype are 4 bytes long, and
+// false for ok if the subtype isn't one that can be parsed
+func bgp4mpAS4(subtype uint16) (as4 bool, ok bool) {
+	switch subtype {
+	case bgp4mpStateChange2, bgp4mpMessage2, bgp4mpMessageLocal2, bgp4mpMessageAddPath2, bgp4mpMessageLocalAddPath2:
+		return false, true
+	case bgp4mpStateChange4, bgp4mpMessage4, bgp4mpMessageLocal4, bgp4mpMessageAddPath4, bgp4mpMessageLocalAddPath4:
+		return true, true
+	}
+	return false, false
+}
+
+// Returns the length of the BGP4MP header at the start of body: peer
+// and local AS, interface index, address family, peer and local IP
+func bgp4mpHeaderLen(body []byte, as4 bool) int {
+	asLen := 2
+	if as4 {
+		asLen = 4
+	}
+	if len(body) < 2*asLen+4 {
+		return 2*asLen + 4
+	}
+	ipLen := 4
+	if binary.BigEndian.Uint16(body[2*asLen+2:2*asLen+4]) == afiIPv6 {
+		ipLen = 16
+	}
+	return 2*asLen + 4 + 2*ipLen
+}
+
+// Returns what follows the BGP4MP header in a raw BGP4MP record: the
+// BGP message starting at the marker, or the old and new state of a
+// state change. Returns nil if the record has no BGP4MP header.
+func bgp4mpMessage(raw []byte) []byte {
+	body, as4, ok := bgp4mpBody(raw)
+	if !ok {
+		return nil
+	}
+	return body[bgp4mpHeaderLen(body, as4):]
+}
+
+// Splits a BGP update message into its withdrawn routes, path
+// attributes and NLRI. ok is false if msg is not a whole update
+func splitUpdate(msg []byte) (withdrawn, attrs, nlri []byte, ok bool) {
+	// BGP header, which must be an update
+	if len(msg) < 19 || msg[18] != 2 {
+		return nil, nil, nil, false
+	}
+	body := msg[19:]
+
+	if len(body) < 2 {
+		return nil, nil, nil, false
+	}
+	wlen := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 2+wlen+2 {
+		return nil, nil, nil, false
+	}
+	withdrawn = body[2 : 2+wlen]
+	body = body[2+wlen:]
+	alen := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 2+alen {
+		return nil, nil, nil, false
+	}
+	attrs = body[2 : 2+alen]
+	nlri = body[2+alen:]
+
+	// The BGP length may be shorter than the MRT record
+	if blen := int(binary.BigEndian.Uint16(msg[16:18])); blen >= 19+4+wlen+alen && blen <= len(msg) {
+		nlri = nlri[:blen-19-4-wlen-alen]
+	}
+	return withdrawn, attrs, nlri, true
+}
+
+// Finds the path attributes of each entry in the body of an
+// AFI/SAFI specific TABLE_DUMP_V2 RIB message
+func ribAttrBlocks(body []byte, subtype uint16) [][]byte {
+	_, entries := ribEntries(body, subtype)
+	var blocks [][]byte
+	for _, ent := range entries {
+		blocks = append(blocks, ent[ribEntryHeaderLen(subtype):])
+	}
+	return blocks
+}
+
+// Returns the length of the fixed part of a RIB entry: the peer
+// index, originated time, path ID with ADD-PATH, and the length of
+// the path attributes. It is 0 for unsupported subtypes
+func ribEntryHeaderLen(subtype uint16) int {
+	switch {
+	case subtype >= ribIPv4Unicast && subtype <= ribIPv6Multicast:
+		return 8
+	case subtype >= ribIPv4UnicastAddPath && subtype <= ribIPv6MulticastAddPath:
+		return 12
+	}
+	return 0
+}
+
+// Splits the body of an AFI/SAFI specific TABLE_DUMP_V2 RIB message
+// into its head, the sequence number and prefix, and its entries.
+// Each entry starts with the header ribEntryHeaderLen describes.
+// Entries past the end of body are left out.
+func ribEntries(body []byte, subtype uint16) (head []byte, entries [][]byte) {
+	hlen := ribEntryHeaderLen(subtype)
+	if hlen == 0 {
+		return nil, nil
+	}
+	// Sequence number and prefix length
+	if len(body) < 5 {
+		return nil, nil
+	}
+	plen := 5 + (int(body[4])+7)/8
+	if len(body) < plen+2 {
+		return nil, nil
+	}
+	head = body[:plen]
+	count := int(binary.BigEndian.Uint16(body[plen : plen+2]))
+	body = body[plen+2:]
+
+	for i := 0; i < count; i++ {
+		if len(body) < hlen {
+			return head, entries
+		}
+		elen := hlen + int(binary.BigEndian.Uint16(body[hlen-2:hlen]))
+		if len(body) < elen {
+			return head, entries
+		}
+		entries = append(entries, body[:elen])
+		body = body[elen:]
+	}
+	return head, entries
+}
@@ -0,0 +1,201 @@
+// The bgpdump formatter, which writes the pipe separated lines of
+// bgpdump -m, so scripts written for bgpdump can read gobgpdump
+// output unchanged:
+//	BGP4MP|<time>|A|<peer IP>|<peer AS>|<prefix>|<AS path>|<origin>|<next hop>|<local pref>|<MED>|<communities>|<AG or NAG>|<aggregator>|
+//	BGP4MP|<time>|W|<peer IP>|<peer AS>|<prefix>
+//	BGP4MP|<time>|STATE|<peer IP>|<peer AS>|<old state>|<new state>
+//	TABLE_DUMP2|<time>|B|<peer IP>|<peer AS>|<prefix>|<AS path>|...
+// RIB lines have the same fields as announcements, and start with
+// TABLE_DUMP for legacy TABLE_DUMP records. BGP4MP_ET messages start
+// with BGP4MP_ET and have microseconds in their time. Like bgpdump, the
+// withdrawals of an update come before its announcements, and OPEN,
+// NOTIFICATION and KEEPALIVE messages are not written.
+
+package gobgpdump
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+)
+
+type BgpdumpFormatter struct{}
+
+func NewBgpdumpFormatter() BgpdumpFormatter {
+	return BgpdumpFormatter{}
+}
+
+func (b BgpdumpFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
+	ts := strconv.FormatInt(mrt.GetTimestamp(mbs).Unix(), 10)
+	if mbs.IsRibStack() {
+		return bgpdumpRib(mbs, ts), nil
+	}
+	// Like bgpdump, BGP4MP_ET messages are written with microseconds
+	kind := "BGP4MP"
+	if usec, ok := getMicroseconds(mbs); ok {
+		kind, ts = "BGP4MP_ET", fmt.Sprintf("%s.%06d", ts, usec)
+	}
+
+	b4h, ok := mbs.Bgp4mpbuf.(pp.BGP4MPHeaderer)
+	if !ok || b4h.GetHeader() == nil {
+		return "", nil
+	}
+	hdr := b4h.GetHeader()
+	peer := fmt.Sprintf("%s|%d", bgpdumpIP(hdr.Peer_IP), hdr.Peer_AS)
+
+	if sc := getStateChange(mbs); sc != nil {
+		return fmt.Sprintf("%s|%s|STATE|%s|%d|%d\n", kind, ts, peer, sc.states.Old, sc.states.New), nil
+	}
+	if bgpMsgType(mbs) != bgpUpdate {
+		return "", nil
+	}
+
+	ret := ""
+	for _, pref := range bgpdumpOrder(getMsgPrefixes(mbs, filter.WdrPrefix)) {
+		ret += fmt.Sprintf("%s|%s|W|%s|%s/%d\n", kind, ts, peer, pref.IP, pref.Mask)
+	}
+	var attrs *pbbgp.BGPUpdate_Attributes
+	if all := getAttrs(mbs); len(all) > 0 {
+		attrs = all[0]
+	}
+	// An update with IPv4 NLRI and IPv6 in MP_REACH_NLRI has a next
+	// hop for each, but only the IPv4 one is in the parsed attributes
+	var mpNextHop net.IP
+	if blocks := getRawAttrBlocks(mbs); len(blocks) > 0 {
+		mpNextHop = parseMPAttrs(blocks[0], nil).nextHop
+	}
+	for _, pref := range bgpdumpOrder(getMsgPrefixes(mbs, filter.AdvPrefix)) {
+		nextHop := mpNextHop
+		if pref.IP.To4() != nil || mpNextHop.To4() != nil {
+			nextHop = nil
+		}
+		ret += fmt.Sprintf("%s|%s|A|%s|%s/%d|%s\n", kind, ts, peer, pref.IP, pref.Mask, bgpdumpAttrs(attrs, nextHop))
+	}
+	return ret, nil
+}
+
+// The bgpdump formatter doesn't need to summarize
+func (b BgpdumpFormatter) summarize() {}
+
+func (b BgpdumpFormatter) formatsInParallel() {}
+
+// Every entry of a RIB message is written as a line of its own.
+// Entries of legacy TABLE_DUMP records are TABLE_DUMP lines
+func bgpdumpRib(mbs *mrt.MrtBufferStack, ts string) string {
+	ribh, ok := mbs.Ribbuf.(pp.RIBHeaderer)
+	if !ok || ribh.GetHeader() == nil {
+		return ""
+	}
+	ir, _ := mbs.Ribbuf.(*indexedRib)
+	kind := "TABLE_DUMP2"
+	if mrth, ok := mbs.MrthBuf.(pp.MRTHeaderer); ok && mrth.GetHeader().Type == mrt.TABLE_DUMP {
+		kind = "TABLE_DUMP"
+	}
+
+	ret := ""
+	for _, ent := range ribh.GetHeader().RouteEntry {
+		if ent.Prefix == nil || ent.Prefix.Prefix == nil {
+			continue
+		}
+		var peer *pbbgp.PeerEntry
+		if ir != nil {
+			peer = ir.peer(ent)
+		}
+		if peer == nil {
+			peer = &pbbgp.PeerEntry{}
+		}
+		pref := prefixRoute(ent.Prefix)
+		ret += fmt.Sprintf("%s|%s|B|%s|%d|%s/%d|%s\n", kind, ts, bgpdumpIP(peer.Peer_IP), peer.Peer_AS,
+			pref.IP, pref.Mask, bgpdumpAttrs(ent.Attrs, nil))
+	}
+	return ret
+}
+
+// Writes the attributes of an announcement, from the AS path to the
+// aggregator, with the closing |. nextHop replaces the next hop of the
+// attributes if it isn't nil
+func bgpdumpAttrs(attrs *pbbgp.BGPUpdate_Attributes, nextHop net.IP) string {
+	if attrs == nil {
+		attrs = &pbbgp.BGPUpdate_Attributes{}
+	}
+	origin := "INCOMPLETE"
+	switch attrs.Origin {
+	case pbbgp.BGPUpdate_Attributes_IGP:
+		origin = "IGP"
+	case pbbgp.BGPUpdate_Attributes_EGP:
+		origin = "EGP"
+	}
+
+	// bgpdump writes 0 for a missing local preference or MED
+	var localPref, med uint32
+	if hasAttr(attrs, pbbgp.BGPUpdate_Attributes_LOCAL_PREF) {
+		localPref = attrs.LocalPref
+	}
+	if hasAttr(attrs, pbbgp.BGPUpdate_Attributes_MULTI_EXIT) {
+		med = attrs.MultiExit
+	}
+
+	var comms []string
+	for _, com := range getCommunities(attrs) {
+		comms = append(comms, bgpdumpCommunity(com))
+	}
+	atomic := "NAG"
+	if attrs.AtomicAggregate {
+		atomic = "AG"
+	}
+	aggr := ""
+	if attrs.Aggregator != nil {
+		aggr = fmt.Sprintf("%d %s", attrs.Aggregator.AS, bgpdumpIP(attrs.Aggregator.IP))
+	}
+
+	if nextHop == nil {
+		nextHop = net.IPv4zero
+		if attrs.NextHop != nil {
+			nextHop = net.IP(util.GetIP(attrs.NextHop))
+		}
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%s|%s|%s|", asPathSegmentString(attrs.ASPath), origin, nextHop,
+		localPref, med, strings.Join(comms, " "), atomic, aggr)
+}
+
+// The well-known communities have names in bgpdump output
+func bgpdumpCommunity(com community) string {
+	if com[0] == 0xffff {
+		switch com[1] {
+		case 0xff01:
+			return "no-export"
+		case 0xff02:
+			return "no-advertise"
+		case 0xff03:
+			return "local-AS"
+		}
+	}
+	return fmt.Sprintf("%d:%d", com[0], com[1])
+}
+
+func bgpdumpIP(ip *pbcom.IPAddressWrapper) string {
+	if ip == nil {
+		return ""
+	}
+	return net.IP(util.GetIP(ip)).String()
+}
+
+// bgpdump writes the classic withdrawn routes and NLRI before the
+// prefixes of MP_REACH_NLRI and MP_UNREACH_NLRI, but getMsgPrefixes
+// returns the MP prefixes first. Moving IPv4 ahead restores the order
+// for the usual case of IPv6 in the MP attributes
+func bgpdumpOrder(routes []mrt.Route) []mrt.Route {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].IP.To4() != nil && routes[j].IP.To4() == nil
+	})
+	return routes
+}
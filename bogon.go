@@ -0,0 +1,274 @@
+// Detection of bogon prefixes and reserved AS numbers. An
+// announcement is a bogon if its prefix is in the bogon list, and a
+// path is suspicious if it contains a private or reserved AS number.
+// gobgpdump has a built-in list, which a bogon file replaces.
+
+package gobgpdump
+
+import (
+	"fmt"
+	"strings"
+
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+// The built-in bogon list. A bogon file has the same format: prefix
+// list entries like in a prefix file, and AS numbers or ranges of AS
+// numbers like 64512-65534. Comments start with #.
+const defaultBogons = `
+# Prefixes too short or too long to be in a global table
+0.0.0.0/0 le 7
+0.0.0.0/0 ge 25
+::/0 le 15
+::/0 ge 49
+
+# Special purpose IPv4 space (RFC 6890 and others)
+0.0.0.0/8
+10.0.0.0/8
+100.64.0.0/10
+127.0.0.0/8
+169.254.0.0/16
+172.16.0.0/12
+192.0.0.0/24
+192.0.2.0/24
+192.168.0.0/16
+198.18.0.0/15
+198.51.100.0/24
+203.0.113.0/24
+224.0.0.0/4
+240.0.0.0/4
+
+# Special purpose IPv6 space
+::/8
+100::/64
+2001:2::/48
+2001:10::/28
+2001:db8::/32
+3ffe::/16
+fc00::/7
+fe80::/10
+fec0::/10
+ff00::/8
+
+# Reserved AS numbers
+0
+23456              # AS_TRANS
+64496-64511        # documentation
+64512-65534        # private use
+65535
+65536-65551        # documentation
+65552-131071       # reserved
+4200000000-4294967294 # private use
+4294967295
+`
+
+type asRange struct {
+	lo, hi uint32
+}
+
+// BogonSet holds the bogon prefixes and reserved AS numbers
+type BogonSet struct {
+	prefixes prefixFilter
+	ases     []asRange
+}
+
+// NewBogonSet reads a bogon file, or the built-in list if fname
+// is empty
+func NewBogonSet(fname string) (*BogonSet, error) {
+	var entries []string
+	var ases []asRange
+	add := func(entry, attr string) error {
+		if attr != "" {
+			return fmt.Errorf("Unexpected attribute %s in bogon list", attr)
+		}
+		if strings.Contains(entry, "/") {
+			entries = append(entries, entry)
+			return nil
+		}
+		r, err := parseASRange(entry)
+		if err != nil {
+			return err
+		}
+		ases = append(ases, r)
+		return nil
+	}
+
+	var err error
+	if fname == "" {
+		err = readList(strings.NewReader(defaultBogons), "built-in bogons", add)
+	} else {
+		err = readListFile(fname, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &BogonSet{ases: ases}
+	if bs.prefixes, err = newPrefixMatcher(entries, filter.AdvPrefix, PrefixOrLonger); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// Parses an AS number like 23456, or a range like 64512-65534
+func parseASRange(str string) (asRange, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) > 2 {
+		return asRange{}, fmt.Errorf("Malformed AS range: %s", str)
+	}
+	lo, err := parseASNumber(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return asRange{}, err
+	}
+	hi := lo
+	if len(parts) == 2 {
+		if hi, err = parseASNumber(strings.TrimSpace(parts[1])); err != nil {
+			return asRange{}, err
+		}
+	}
+	if hi < lo {
+		return asRange{}, fmt.Errorf("Malformed AS range: %s", str)
+	}
+	return asRange{lo, hi}, nil
+}
+
+func (bs *BogonSet) isReservedAS(as uint32) bool {
+	for _, r := range bs.ases {
+		if as >= r.lo && as <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// The bogons found in one message
+type bogonResult struct {
+	Prefixes []string `json:"prefixes,omitempty"`
+	ASNs     []uint32 `json:"asns,omitempty"`
+}
+
+// Returns the bogon prefixes a message announces and the reserved
+// AS numbers in its paths, or nil if there are none
+func (bs *BogonSet) check(mbs *mrt.MrtBufferStack) *bogonResult {
+	res := &bogonResult{}
+	for _, pref := range getMsgPrefixes(mbs, filter.AdvPrefix) {
+		if bs.prefixes.matches(pref.IP, pref.Mask) {
+			res.Prefixes = append(res.Prefixes, fmt.Sprintf("%s/%d", pref.IP, pref.Mask))
+		}
+	}
+	for _, path := range getASPaths(mbs) {
+		for _, as := range path {
+			if bs.isReservedAS(as) && !containsAS(res.ASNs, as) {
+				res.ASNs = append(res.ASNs, as)
+			}
+		}
+	}
+	if res.Prefixes == nil && res.ASNs == nil {
+		return nil
+	}
+	return res
+}
+
+// Returns a one word description of a route for the ml formatter:
+// "prefix" for a bogon prefix, "asn" for a path with a reserved AS,
+// both joined by a + or an empty string
+func (bs *BogonSet) describe(pref mrt.Route, path []uint32) string {
+	var kinds []string
+	if bs.prefixes.matches(pref.IP, pref.Mask) {
+		kinds = append(kinds, "prefix")
+	}
+	for _, as := range path {
+		if bs.isReservedAS(as) {
+			kinds = append(kinds, "asn")
+			break
+		}
+	}
+	return strings.Join(kinds, "+")
+}
+
+func containsAS(ases []uint32, as uint32) bool {
+	for _, a := range ases {
+		if a == as {
+			return true
+		}
+	}
+	return false
+}
+
+type BogonMode int
+
+const (
+	BogonsOff      = BogonMode(iota)
+	BogonsAnnotate // only annotate json and ml output
+	BogonsDrop     // drop bogon prefixes, and messages with reserved AS's
+	BogonsOnly     // pass only messages with bogons
+)
+
+func parseBogonMode(str string) (BogonMode, error) {
+	switch strings.ToLower(str) {
+	case "":
+		return BogonsOff, nil
+	case "annotate":
+		return BogonsAnnotate, nil
+	case "drop":
+		return BogonsDrop, nil
+	case "only":
+		return BogonsOnly, nil
+	}
+	return 0, fmt.Errorf("Unknown bogon mode: %s", str)
+}
+
+// Passes only the messages with bogons
+type bogonFilter struct {
+	bs *BogonSet
+}
+
+func (bf bogonFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	return bf.bs.check(mbs) != nil
+}
+
+// Removes the bogon prefixes a message announces. Returns false if
+// the message should be dropped, because it has a path with a
+// reserved AS number, or because no prefix is left. Withdrawals and
+// messages without prefixes are kept, and RIB messages are kept or
+// dropped whole, since all their entries have the same prefix.
+func (bs *BogonSet) dropBogons(mbs *mrt.MrtBufferStack) bool {
+	for _, path := range getASPaths(mbs) {
+		for _, as := range path {
+			if bs.isReservedAS(as) {
+				return false
+			}
+		}
+	}
+	if mbs.IsRibStack() {
+		for _, pref := range getMsgPrefixes(mbs, filter.AdvPrefix) {
+			return !bs.prefixes.matches(pref.IP, pref.Mask)
+		}
+		return true
+	}
+
+	upd, ok := mbs.Bgpupbuf.(pp.BGPUpdater)
+	if !ok || upd.GetUpdate() == nil || upd.GetUpdate().AdvertisedRoutes == nil {
+		return true
+	}
+	update := upd.GetUpdate()
+	var adv []*pbcom.PrefixWrapper
+	for _, pref := range update.AdvertisedRoutes.Prefixes {
+		route := prefixRoute(pref)
+		if !bs.prefixes.matches(route.IP, route.Mask) {
+			adv = append(adv, pref)
+		}
+	}
+	if len(adv) == len(update.AdvertisedRoutes.Prefixes) {
+		return true
+	}
+	var wdr []*pbcom.PrefixWrapper
+	if update.WithdrawnRoutes != nil {
+		wdr = update.WithdrawnRoutes.Prefixes
+	}
+	setPrefixes(update, adv, wdr)
+	return len(adv) > 0 || len(wdr) > 0
+}
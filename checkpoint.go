@@ -0,0 +1,314 @@
+// Checkpoints of a long dump, so it can be resumed after a crash.
+// A checkpoint has the input files read to the end, the size of the
+// dump output and the state of the formatter. It is only written while
+// no file is being read, so the output and state hold all of the files
+// done and nothing of any other: once a checkpoint is due, the workers
+// finish their files and wait for it to be written before starting
+// new ones.
+//
+// On resume, the dump output is cut back to its size at the
+// checkpoint, the formatter state is loaded, and the files done are
+// skipped. Checkpoints are written to a temporary file which is then
+// renamed, so a crash while writing one leaves the last one intact.
+
+package gobgpdump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// The default time between checkpoints
+const DefaultCheckpointEvery = "10m"
+
+// A checkpoint as it is written to the checkpoint file
+type checkpointFile struct {
+	Time      time.Time
+	Formatter string
+	Done      []string        // the input files read to the end
+	DumpSize  int64           // the size of the dump output, if it is a file
+	State     json.RawMessage `json:",omitempty"`
+}
+
+// A Formatter with state to save in a checkpoint. saveState is only
+// called while no file is being read, and loadState before any is.
+// Formatters without these methods keep nothing between messages
+type stateFormatter interface {
+	Formatter
+	saveState() (interface{}, error)
+	loadState(json.RawMessage) error
+}
+
+// Checks the checkpoint options, and reads the checkpoint to resume
+// from. Returns nil if the dump isn't resumed, or if there is no
+// checkpoint yet
+func readCheckpoint(configFile ConfigFile) (*checkpointFile, error) {
+	if configFile.Checkpt == "" {
+		if configFile.Resume {
+			return nil, fmt.Errorf("Resuming needs a checkpoint file")
+		}
+		return nil, nil
+	}
+	// Neither has a point where the output only holds whole files
+	if configFile.Ordered {
+		return nil, fmt.Errorf("Ordered output can't be checkpointed")
+	}
+	if configFile.Reindex {
+		return nil, fmt.Errorf("Reindexed mrt output can't be checkpointed")
+	}
+	if !configFile.Resume {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(configFile.Checkpt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := &checkpointFile{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("Error reading checkpoint %s: %s", configFile.Checkpt, err)
+	}
+	if saved.Formatter != configFile.Fmtr {
+		return nil, fmt.Errorf("The checkpoint %s is of the %s formatter, not %s", configFile.Checkpt, saved.Formatter, configFile.Fmtr)
+	}
+	return saved, nil
+}
+
+// Creates an output file, or opens it to append to when resuming
+func createOutput(name string, resumed bool) (*os.File, error) {
+	if resumed {
+		return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	}
+	return os.Create(name)
+}
+
+// Opens the dump output of a resumed dump, without whatever was
+// written to it after the checkpoint
+func resumeDump(name string, size int64) (*os.File, error) {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if fi.Mode().IsRegular() {
+		if fi.Size() < size {
+			fd.Close()
+			return nil, fmt.Errorf("The dump output %s is shorter than at the checkpoint", name)
+		}
+		if err := fd.Truncate(size); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Writes the checkpoints of a dump. The zero checkpointer of a dump
+// without checkpoints is nil, and its methods do nothing
+type checkpointer struct {
+	path  string
+	every time.Duration
+	saved checkpointFile
+	skip  map[string]bool // the files done before a resumed dump
+	fmtr  Formatter
+	dump  *os.File // nil if the dump output isn't a file
+	log   *MultiWriteFile
+
+	mux         *sync.Mutex
+	cond        *sync.Cond
+	reading     int  // the number of files being read
+	due         bool // no file is started until the checkpoint is written
+	interrupted bool // a file was stopped partway, so no checkpoint can be written
+	last        time.Time
+	lastDone    int // the number of files done at the last checkpoint
+}
+
+// Returns the checkpointer of a dump, and loads the formatter state if
+// the dump is resumed from saved
+func newCheckpointer(configFile ConfigFile, saved *checkpointFile, fmtr Formatter, dump *os.File, log *MultiWriteFile) (*checkpointer, error) {
+	every := configFile.CkptEvery
+	if every == "" {
+		every = DefaultCheckpointEvery
+	}
+	d, err := time.ParseDuration(every)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing checkpoint interval: %s", every)
+	}
+
+	// Only the size of a regular file can be checkpointed
+	if dump != nil {
+		if fi, err := dump.Stat(); err != nil || !fi.Mode().IsRegular() {
+			dump = nil
+		}
+	}
+
+	mux := &sync.Mutex{}
+	cp := &checkpointer{path: configFile.Checkpt, every: d, fmtr: fmtr, dump: dump, log: log,
+		mux: mux, cond: sync.NewCond(mux), last: time.Now()}
+	cp.saved.Formatter = configFile.Fmtr
+	cp.skip = make(map[string]bool)
+
+	if saved == nil {
+		if configFile.Resume {
+			log.WriteString(fmt.Sprintf("No checkpoint in %s, starting from the beginning\n", cp.path))
+		}
+		return cp, nil
+	}
+	if sf, ok := fmtr.(stateFormatter); ok && len(saved.State) > 0 {
+		if err := sf.loadState(saved.State); err != nil {
+			return nil, fmt.Errorf("Error loading formatter state from %s: %s", cp.path, err)
+		}
+	}
+	cp.saved.Done = saved.Done
+	cp.lastDone = len(saved.Done)
+	for _, name := range saved.Done {
+		cp.skip[name] = true
+	}
+	log.WriteString(fmt.Sprintf("Resuming from the checkpoint of %s in %s, %d files done\n", saved.Time.Format(time.RFC3339), cp.path, len(saved.Done)))
+	if dump == nil {
+		log.WriteString("The dump output isn't a file, so output after the checkpoint is written again\n")
+	}
+	return cp, nil
+}
+
+// Called before a worker reads a file. Waits for any checkpoint that
+// is due to be written, and returns false if the file shouldn't be
+// read, because it was done before the dump was resumed or because the
+// dump was interrupted
+func (cp *checkpointer) startFile(name string) bool {
+	if cp == nil {
+		return true
+	}
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	if cp.skip[name] {
+		cp.log.WriteString(fmt.Sprintf("Skipping %s, done before the checkpoint\n", name))
+		return false
+	}
+	for cp.due {
+		cp.cond.Wait()
+	}
+	if cp.interrupted {
+		return false
+	}
+	cp.reading++
+	return true
+}
+
+// Called once a worker is done with a file. A file stopped by ctx is
+// not done, and part of it may be in the output, so no checkpoint is
+// written after it. Any other file is done, even if it had errors.
+// The checkpoint is written by the last file to end once it is due
+func (cp *checkpointer) endFile(ctx context.Context, name string) {
+	if cp == nil {
+		return
+	}
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	cp.reading--
+	if ctx.Err() != nil {
+		cp.interrupted = true
+		cp.due = false
+		cp.cond.Broadcast()
+		return
+	}
+
+	cp.saved.Done = append(cp.saved.Done, name)
+	if !cp.interrupted && time.Since(cp.last) >= cp.every {
+		cp.due = true
+	}
+	if cp.due && cp.reading == 0 {
+		cp.save()
+		cp.due = false
+		cp.cond.Broadcast()
+	}
+}
+
+// Writes the last checkpoint, once every worker is done and before the
+// formatter summarizes. Resuming from it only summarizes again
+func (cp *checkpointer) finish() {
+	if cp == nil {
+		return
+	}
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	if !cp.interrupted && len(cp.saved.Done) != cp.lastDone {
+		cp.save()
+	}
+}
+
+// Writes a checkpoint. Errors are logged, and the dump goes on
+func (cp *checkpointer) save() {
+	cp.last = time.Now()
+	cp.lastDone = len(cp.saved.Done)
+	if err := cp.write(); err != nil {
+		cp.log.WriteString(fmt.Sprintf("Error writing checkpoint %s: %s\n", cp.path, err))
+		return
+	}
+	cp.log.WriteString(fmt.Sprintf("Checkpoint written to %s, %d files done\n", cp.path, len(cp.saved.Done)))
+}
+
+func (cp *checkpointer) write() error {
+	cp.saved.Time = cp.last
+	cp.saved.State = nil
+	if sf, ok := cp.fmtr.(stateFormatter); ok {
+		state, err := sf.saveState()
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			if cp.saved.State, err = json.Marshal(state); err != nil {
+				return err
+			}
+		}
+	}
+	// The output must be on disk before a checkpoint that has it
+	if cp.dump != nil {
+		if err := cp.dump.Sync(); err != nil {
+			return err
+		}
+		fi, err := cp.dump.Stat()
+		if err != nil {
+			return err
+		}
+		cp.saved.DumpSize = fi.Size()
+	}
+
+	data, err := json.Marshal(cp.saved)
+	if err != nil {
+		return err
+	}
+	tmp := cp.path + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, cp.path)
+}
@@ -4,10 +4,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	. "github.com/CSUNetSec/gobgpdump"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -19,14 +23,46 @@ func init() {
 	flag.StringVar(&configFile.Do, "o", "stdout", "file to place dump output")
 	flag.StringVar(&configFile.Fmtr, "fmtr", "text", "format to output results in.\n"+
 		"Available Formats:\n"+
-		"pup, pts, day, json, text, ml, prefixlock, id")
+		"pup, pts, day, json, text, ml, csv, bgpdump, prefixlock, mrt (or id)")
+	flag.StringVar(&configFile.Compress, "compress", "", "compress mrt output; one of [gzip, bzip2, zstd]")
+	flag.BoolVar(&configFile.Reindex, "reindex", false, "write mrt output with a single PEER_INDEX_TABLE of only the peers of the RIB entries written")
+	flag.StringVar(&configFile.Fields, "fields", "", "list of comma separated fields for the csv format (default "+DefaultCSVFields+")")
 	flag.StringVar(&configFile.Srcas, "srcas", "", "list of comma separated AS's (e.g. 1,2,3,4) to filter message source by")
+	flag.StringVar(&configFile.ASFile, "as-file", "", "file of source AS's to filter by, one per line or as RPSL origin attributes")
 	flag.StringVar(&configFile.Destas, "destas", "", "list of comma separated AS's (e.g. 1,2,3,4) to filter message destination by")
+	flag.StringVar(&configFile.ASPath, "aspath", "", "regular expression to match the AS path by (e.g. _3356_174_ or '^65000 .* 13335$')")
+	flag.IntVar(&configFile.MinPathLn, "minpathlen", 0, "only pass messages with an AS path at least this long")
+	flag.IntVar(&configFile.MaxPathLn, "maxpathlen", 0, "only pass messages with an AS path at most this long")
+	flag.StringVar(&configFile.PeerIP, "peerip", "", "list of comma separated peer IPs or prefixes to filter the BGP session by")
+	flag.StringVar(&configFile.PeerAS, "peeras", "", "list of comma separated peer AS's to filter the BGP session by")
+	flag.StringVar(&configFile.LocalIP, "localip", "", "list of comma separated local (collector) IPs or prefixes to filter the BGP session by")
+	flag.StringVar(&configFile.LocalAS, "localas", "", "list of comma separated local (collector) AS's to filter the BGP session by")
+	flag.StringVar(&configFile.Community, "community", "", "list of comma separated communities (e.g. 3356:666,*:666,no-export) to filter by")
+	flag.StringVar(&configFile.LargeComm, "lcommunity", "", "list of comma separated large communities (e.g. 65000:1:2,65000:*:*) to filter by")
 	flag.StringVar(&configFile.PrefList, "prefixes", "", "list of commma separated prefixes. Messages containing any in the list will pass filters")
+	flag.StringVar(&configFile.PrefFile, "prefix-file", "", "file of prefixes to filter by, one per line or as RPSL route/route6 objects")
 	flag.StringVar(&configFile.PrefLoc, "prefloc", "", "where to filter for prefixes; one of [any, advertized, withdrawn]")
+	flag.StringVar(&configFile.Filter, "filter", "", "filter expression combining filters with and, or, not (e.g. 'srcas(3356) and not prefix(10.0.0.0/8)')")
+	flag.StringVar(&configFile.AFI, "afi", "", "only look at prefixes of one address family; one of [ipv4, ipv6]. Messages without any are dropped")
+	flag.StringVar(&configFile.MsgTypes, "msgtype", "update,rib", "list of comma separated message types to pass; any of [announce, withdraw, eor, update, state, open, notification, keepalive, other, rib, all]")
+	flag.StringVar(&configFile.PrefMode, "prefmode", "orlonger", "how listed prefixes match message prefixes; one of [exact, orlonger, longer, orshorter, shorter]")
+	flag.StringVar(&configFile.VRPFile, "vrp", "", "VRP file (rpki-client JSON or Routinator CSV) to validate announcements against. Adds the RPKI state to json and ml output")
+	flag.StringVar(&configFile.ROV, "rov", "", "list of comma separated RPKI validation states to filter by; any of [valid, invalid, notfound]. Needs -vrp")
+	flag.StringVar(&configFile.Bogons, "bogons", "", "check for bogon prefixes and reserved AS's; one of [annotate, drop, only]. All of them annotate json and ml output")
+	flag.StringVar(&configFile.BogonFile, "bogon-file", "", "file of bogon prefixes and reserved AS ranges, to use instead of the built-in list")
+	flag.StringVar(&configFile.StartTime, "start", "", "only pass messages at or after this time (RFC3339 or unix timestamp)")
+	flag.StringVar(&configFile.EndTime, "end", "", "only pass messages before this time (RFC3339 or unix timestamp)")
+	flag.StringVar(&configFile.OnError, "onerr", "skipfile", "what to do when a file or message can't be read; one of [abort, skipfile, skipmsg]")
+	flag.BoolVar(&configFile.Resync, "resync", false, "skip corrupt records, and search past corrupt headers for the next MRT message")
 	flag.BoolVar(&configFile.Conf, "conf", false, "draw configuration from a file")
 	flag.BoolVar(&configFile.Debug, "debug", false, "set the debug flag")
-	flag.IntVar(&configFile.Wc, "wc", 1, "number of worker threads to use (max 16)")
+	flag.IntVar(&configFile.Wc, "wc", 1, "number of files to read at once")
+	flag.IntVar(&configFile.Pwc, "pwc", 1, "number of goroutines parsing each file. Up to wc*pwc records are parsed at once")
+	flag.BoolVar(&configFile.Ordered, "ordered", false, "write the messages of all input files as one stream in time order")
+	flag.StringVar(&configFile.Checkpt, "checkpoint", "", "file to save the progress of the dump in, so it can be resumed with -resume")
+	flag.StringVar(&configFile.CkptEvery, "checkpoint-every", DefaultCheckpointEvery, "time between checkpoints")
+	flag.BoolVar(&configFile.Resume, "resume", false, "carry on from the checkpoint, skipping the files done and appending to the output files")
+	flag.StringVar(&configFile.Progress, "progress", "", "write a JSON progress report to the stat output this often (e.g. 30s)")
 }
 
 func main() {
@@ -38,12 +74,29 @@ func main() {
 		return
 	}
 
+	// SIGINT and SIGTERM stop the workers, but everything they have
+	// done is still summarized. A second signal kills the program.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		stop()
+	}()
+	ctx := dc.AbortContext(sigCtx)
+
 	dumpStart := time.Now()
+	dc.StartProgress()
+	if dc.Ordered() {
+		DumpOrdered(ctx, dc)
+		dc.SummarizeAndClose(dumpStart)
+		return
+	}
+
 	wg := &sync.WaitGroup{}
 	// Launch worker threads
 	for w := 0; w < dc.GetWorkers(); w++ {
 		wg.Add(1)
-		go DumpWorker(dc, wg)
+		go DumpWorker(ctx, dc, wg)
 	}
 
 	wg.Wait()
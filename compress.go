@@ -0,0 +1,160 @@
+// Detection and decompression of compressed input files, and
+// compression of MRT output. The codec of an input is always chosen
+// from the first bytes of the data, never from the file extension,
+// so mislabelled files are read correctly.
+
+package gobgpdump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os/exec"
+)
+
+// The name used in the log for data that is not compressed
+const noCodec = "none"
+
+// A codec is a compression format that gobgpdump can read
+type codec struct {
+	name  string
+	match func([]byte) bool
+	open  func(io.Reader) (io.ReadCloser, error)
+}
+
+// The longest header any codec needs to look at
+const magicLen = 10
+
+var codecs = []codec{
+	{"bzip2", isBzip2Header, openBzip2},
+	{"gzip", hasMagic([]byte{0x1f, 0x8b}), openGzip},
+	{"xz", hasMagic([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}), openXz},
+	{"zstd", hasMagic([]byte{0x28, 0xb5, 0x2f, 0xfd}), openZstd},
+}
+
+func hasMagic(magic []byte) func([]byte) bool {
+	return func(head []byte) bool {
+		return bytes.HasPrefix(head, magic)
+	}
+}
+
+// "BZh" alone is a valid MRT timestamp from 2005, so the block size
+// and the magic number of the first block are checked as well
+func isBzip2Header(head []byte) bool {
+	if len(head) < magicLen || !bytes.HasPrefix(head, []byte("BZh")) {
+		return false
+	}
+	if head[3] < '1' || head[3] > '9' {
+		return false
+	}
+	block := head[4:10]
+	return bytes.Equal(block, []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}) ||
+		bytes.Equal(block, []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90})
+}
+
+func openBzip2(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func openGzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func openXz(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xr), nil
+}
+
+// Several files are read at once already, so each is decoded without
+// goroutines of its own
+func openZstd(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// Looks at the first bytes of r and returns a reader of the
+// decompressed data, along with the name of the codec used
+func getDecompressor(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	// A short read just means none of the codecs will match
+	head, _ := br.Peek(magicLen)
+	for _, c := range codecs {
+		if c.match(head) {
+			rc, err := c.open(br)
+			return rc, c.name, err
+		}
+	}
+	return ioutil.NopCloser(br), noCodec, nil
+}
+
+// Returns a writer that compresses to w with the named codec. It must
+// be closed to finish the compressed data, which doesn't close w.
+// bzip2 data is piped through the bzip2 command, since the standard
+// library can only decompress it
+func getCompressor(w io.Writer, name string) (io.WriteCloser, error) {
+	switch name {
+	case "", noCodec:
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "bzip2":
+		return startCompressCommand(w, "bzip2", "-c")
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("Unknown output compression: %s", name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Writes to the input of a compression command, which writes
+// the compressed data to w
+type commandWriter struct {
+	in     io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func startCompressCommand(w io.Writer, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s output needs the %s command: %s", name, name, err)
+	}
+	return &commandWriter{in: in, cmd: cmd, stderr: stderr}, nil
+}
+
+func (cw *commandWriter) Write(p []byte) (int, error) {
+	return cw.in.Write(p)
+}
+
+// Waits for the command to write the rest of the compressed data
+func (cw *commandWriter) Close() error {
+	cw.in.Close()
+	if err := cw.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s %s", cw.cmd.Path, err, bytes.TrimSpace(cw.stderr.Bytes()))
+	}
+	return nil
+}
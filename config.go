@@ -10,11 +10,13 @@ package gobgpdump
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/CSUNetSec/protoparse/filter"
 	"io"
+	"io/ioutil"
 	golog "log"
 	"os"
 	"strings"
@@ -30,40 +32,148 @@ var (
 // This is just convenient so it can be read
 // as a json object
 type ConfigFile struct {
-	Collist  []string //List of collectors
-	Start    string   // Start month		These first three are only used in configuration option, which is why they don't have flags
-	End      string   //end month
-	Lo       string   //Log output
-	So       string   //Stat output
-	Do       string   //dump output
-	Wc       int      //worker count
-	Fmtr     string   //output format
-	Conf     bool     //get config from a file
-	Srcas    string   `json:"Srcas,omitempty"`
-	Destas   string   `json:"Destas,omitempty"`
-	Anyas    string   `json:"Anyas,omitempty"`
-	PrefList string   `json:"Prefixes,omitempty"`
-	PrefLoc  string   `json:PrefLoc,omitempty`
-	Debug    bool     // sets the global debug flag for the package
+	Collist   []string //List of collectors
+	Start     string   // Start month		These first three are only used in configuration option, which is why they don't have flags
+	End       string   //end month
+	Lo        string   //Log output
+	So        string   //Stat output
+	Do        string   //dump output
+	Wc        int      //worker count
+	Pwc       int      `json:"Pwc,omitempty"` // goroutines parsing each file
+	Fmtr      string   //output format
+	Fields    string   `json:"Fields,omitempty"`   // columns of the csv format
+	Compress  string   `json:"Compress,omitempty"` // compression of mrt output, one of gzip, bzip2, zstd
+	Reindex   bool     `json:"Reindex,omitempty"`  // write one PEER_INDEX_TABLE of the peers in mrt output
+	Ordered   bool     `json:"Ordered,omitempty"`  // merge the messages of every file in time order
+	Conf      bool     //get config from a file
+	Srcas     string   `json:"Srcas,omitempty"`
+	Destas    string   `json:"Destas,omitempty"`
+	ASFile    string   `json:"ASFile,omitempty"` // file of AS numbers, added to Srcas
+	Anyas     string   `json:"Anyas,omitempty"`
+	PeerIP    string   `json:"PeerIP,omitempty"`
+	PeerAS    string   `json:"PeerAS,omitempty"`
+	LocalIP   string   `json:"LocalIP,omitempty"`
+	LocalAS   string   `json:"LocalAS,omitempty"`
+	ASPath    string   `json:"ASPath,omitempty"`     // AS path regular expression
+	MinPathLn int      `json:"MinPathLen,omitempty"` // 0 for no minimum
+	MaxPathLn int      `json:"MaxPathLen,omitempty"` // 0 for no maximum
+	Community string   `json:"Community,omitempty"`
+	LargeComm string   `json:"LargeCommunity,omitempty"`
+	PrefList  string   `json:"Prefixes,omitempty"`
+	PrefFile  string   `json:"PrefixFile,omitempty"` // file of prefixes, added to Prefixes
+	PrefLoc   string   `json:"PrefLoc,omitempty"`
+	PrefMode  string   `json:"PrefMode,omitempty"`  // default match mode of the prefix list, see prefix.go
+	AFI       string   `json:"AFI,omitempty"`       // ipv4 or ipv6, empty for both
+	MsgTypes  string   `json:"MsgTypes,omitempty"`  // message classes to pass, see msgtype.go
+	VRPFile   string   `json:"VRPFile,omitempty"`   // rpki-client JSON or Routinator CSV
+	ROV       string   `json:"ROV,omitempty"`       // RPKI validation states to pass
+	Bogons    string   `json:"Bogons,omitempty"`    // one of annotate, drop, only
+	BogonFile string   `json:"BogonFile,omitempty"` // replaces the built-in bogon list
+	Filter    string   `json:"Filter,omitempty"`    // filter expression, see expr.go
+	StartTime string   `json:"StartTime,omitempty"` // RFC3339 or unix time, inclusive
+	EndTime   string   `json:"EndTime,omitempty"`   // RFC3339 or unix time, exclusive
+	OnError   string   `json:"OnError,omitempty"`   // one of abort, skipfile, skipmsg
+	Resync    bool     `json:"Resync,omitempty"`    // skip corrupt records instead of abandoning the file
+	Debug     bool     // sets the global debug flag for the package
+
+	// Checkpoints and progress reports of a long dump, see
+	// checkpoint.go and progress.go
+	Checkpt   string `json:"Checkpoint,omitempty"`      // file to save the progress of the dump in
+	CkptEvery string `json:"CheckpointEvery,omitempty"` // time between checkpoints, like 10m
+	Resume    bool   `json:"-"`                         // carry on from the checkpoint, only a command line option
+	Progress  string `json:"Progress,omitempty"`        // time between progress reports in the stat output
+}
+
+// What a worker does when a file can't be opened, or a message
+// in it can't be parsed
+type ErrorPolicy int
+
+const (
+	OnErrorSkipFile = ErrorPolicy(iota) // log the error and move on to the next file
+	OnErrorSkipMsg                      // log the error and move on to the next message
+	OnErrorAbort                        // stop every worker
+)
+
+func parseErrorPolicy(str string) (ErrorPolicy, error) {
+	switch str {
+	case "", "skipfile":
+		return OnErrorSkipFile, nil
+	case "skipmsg":
+		return OnErrorSkipMsg, nil
+	case "abort":
+		return OnErrorAbort, nil
+	}
+	return OnErrorSkipFile, fmt.Errorf("Unknown error policy: %s", str)
 }
 
 // This struct is the complete parameter set for a file
 // dump.
 type DumpConfig struct {
 	workers int
+	parsers int // the parse workers of each file
 	source  stringsource
 	fmtr    Formatter
 	filters []filter.Filter
 	dump    *MultiWriteFile
 	log     *MultiWriteFile
 	stat    *MultiWriteFile
+	onError ErrorPolicy
+	resync  bool
+	ordered bool
+	window  *timeWindow
+	afi     int
+	classes MsgClass
+	rov     *ROVValidator
+	bogons  *BogonSet
+	drop    bool // whether bogon prefixes are dropped
+	cancel  context.CancelFunc
+	cp      *checkpointer
+	prog    *progress
 }
 
 func (dc *DumpConfig) GetWorkers() int {
 	return dc.workers
 }
 
+// If this is true, the dump should be run with DumpOrdered
+// rather than with DumpWorker
+func (dc *DumpConfig) Ordered() bool {
+	return dc.ordered
+}
+
+// Returns a context derived from parent, which is cancelled when
+// a worker aborts the dump under the abort error policy. Workers
+// should be passed this context.
+func (dc *DumpConfig) AbortContext(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	dc.cancel = cancel
+	return ctx
+}
+
+func (dc *DumpConfig) abort() {
+	if dc.cancel != nil {
+		dc.cancel()
+	}
+}
+
+// Returns the collector of an input file, which is only known when
+// the files come from a collector format file
+func (dc *DumpConfig) collector(name string) string {
+	if ds, ok := dc.source.(*DirectorySource); ok {
+		return ds.collector(name)
+	}
+	return ""
+}
+
+// Starts writing progress reports to the stat output, if they were
+// asked for. They stop with SummarizeAndClose
+func (dc *DumpConfig) StartProgress() {
+	dc.prog.run()
+}
+
 func (dc *DumpConfig) SummarizeAndClose(start time.Time) {
+	dc.prog.stop()
+	dc.cp.finish()
 	dc.fmtr.summarize()
 	dc.stat.WriteString(fmt.Sprintf("Total time taken: %s\n", time.Since(start)))
 	dc.CloseAll()
@@ -91,6 +201,21 @@ func GetDumpConfig(configFile ConfigFile) (*DumpConfig, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Error parsing configuration: %s", err)
 		}
+		// The checkpoint, progress and parse worker options can also
+		// be given on the command line
+		if newConfig.Checkpt == "" {
+			newConfig.Checkpt = configFile.Checkpt
+		}
+		if newConfig.CkptEvery == "" {
+			newConfig.CkptEvery = configFile.CkptEvery
+		}
+		newConfig.Resume = configFile.Resume
+		if newConfig.Progress == "" {
+			newConfig.Progress = configFile.Progress
+		}
+		if newConfig.Pwc == 0 {
+			newConfig.Pwc = configFile.Pwc
+		}
 		configFile = newConfig
 		dc.source = ss
 	} else {
@@ -98,15 +223,48 @@ func GetDumpConfig(configFile ConfigFile) (*DumpConfig, error) {
 	}
 
 	dc.workers = configFile.Wc
+	dc.parsers = configFile.Pwc
+	if dc.parsers < 1 {
+		dc.parsers = 1
+	}
+	dc.ordered = configFile.Ordered
+
+	onError, err := parseErrorPolicy(configFile.OnError)
+	if err != nil {
+		return nil, err
+	}
+	dc.onError = onError
+	dc.resync = configFile.Resync
+
+	if dc.afi, err = parseAFI(configFile.AFI); err != nil {
+		return nil, err
+	}
+	if dc.classes, err = parseMsgClasses(configFile.MsgTypes); err != nil {
+		return nil, err
+	}
+
+	// A resumed dump appends to its output files
+	saved, err := readCheckpoint(configFile)
+	if err != nil {
+		return nil, err
+	}
+	resumed := saved != nil
 
 	// This error is ignored. If there is an error, output to that file just gets trashed
 	var dump io.WriteCloser
+	var dumpFile *os.File
 	if configFile.Do == "stdout" {
 		dump = os.Stdout
 	} else if configFile.Do == "" {
 		dump = DiscardCloser{}
+	} else if resumed {
+		if dumpFile, err = resumeDump(configFile.Do, saved.DumpSize); err != nil {
+			return nil, err
+		}
+		dump = dumpFile
 	} else {
-		dump, _ = os.Create(configFile.Do)
+		dumpFile, _ = os.Create(configFile.Do)
+		dump = dumpFile
 	}
 	dc.dump = NewMultiWriteFile(dump)
 
@@ -116,9 +274,14 @@ func GetDumpConfig(configFile ConfigFile) (*DumpConfig, error) {
 	} else if configFile.So == "" {
 		stat = DiscardCloser{}
 	} else {
-		stat, _ = os.Create(configFile.So)
+		stat, _ = createOutput(configFile.So, resumed)
 	}
 	dc.stat = NewMultiWriteFile(stat)
+	if configFile.Progress != "" {
+		if dc.prog, err = newProgress(configFile.Progress, dc.source, dc.stat); err != nil {
+			return nil, err
+		}
+	}
 
 	var log io.WriteCloser
 	if configFile.Lo == "stdout" {
@@ -126,27 +289,93 @@ func GetDumpConfig(configFile ConfigFile) (*DumpConfig, error) {
 	} else if configFile.Lo == "" {
 		log = DiscardCloser{}
 	} else {
-		log, _ = os.Create(configFile.Lo)
+		log, _ = createOutput(configFile.Lo, resumed)
 	}
 	dc.log = NewMultiWriteFile(log)
 	golog.SetOutput(dc.log)
 
+	if configFile.VRPFile != "" {
+		if dc.rov, err = NewROVValidator(configFile.VRPFile); err != nil {
+			return nil, err
+		}
+		dc.log.WriteString(fmt.Sprintf("Loaded %d VRPs from %s\n", dc.rov.Len(), configFile.VRPFile))
+	} else if configFile.ROV != "" {
+		return nil, fmt.Errorf("RPKI validation needs a VRP file")
+	}
+
+	bogonMode, err := parseBogonMode(configFile.Bogons)
+	if err != nil {
+		return nil, err
+	}
+	// A bogon file alone turns on annotation
+	if bogonMode == BogonsOff && configFile.BogonFile != "" {
+		bogonMode = BogonsAnnotate
+	}
+	if bogonMode != BogonsOff {
+		if dc.bogons, err = NewBogonSet(configFile.BogonFile); err != nil {
+			return nil, err
+		}
+	}
+
 	// This will need access to redirected output files
-	dc.fmtr = getFormatter(configFile, dump)
+	if dc.fmtr, err = getFormatter(configFile, dump, resumed, dc.rov, dc.bogons); err != nil {
+		return nil, err
+	}
+	if configFile.Checkpt != "" {
+		if dc.cp, err = newCheckpointer(configFile, saved, dc.fmtr, dumpFile, dc.log); err != nil {
+			return nil, err
+		}
+	}
 
 	filts, err := getFilters(configFile)
-	dc.filters = filts
 	if err != nil {
 		return nil, err
 	}
+	if configFile.ROV != "" {
+		rovFilt, err := newROVFilter(dc.rov, configFile.ROV)
+		if err != nil {
+			return nil, err
+		}
+		filts = append(filts, rovFilt)
+	}
+	dc.drop = bogonMode == BogonsDrop
+	if bogonMode == BogonsOnly {
+		filts = append(filts, bogonFilter{dc.bogons}.filter)
+	}
+
+	dc.window, err = newTimeWindow(configFile.StartTime, configFile.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	// The time filter is the cheapest, so it goes first
+	if dc.window != nil {
+		filts = append([]filter.Filter{dc.window.filter}, filts...)
+	}
+	dc.filters = filts
 
 	return &dc, nil
 }
 
 func getFilters(configFile ConfigFile) ([]filter.Filter, error) {
 	var filters []filter.Filter
-	if configFile.Srcas != "" {
-		srcFilt, err := filter.NewASFilter(configFile.Srcas, filter.AS_SOURCE)
+	// ASes from the AS file are added to the source AS list
+	if configFile.Srcas != "" || configFile.ASFile != "" {
+		var ases []uint32
+		if configFile.Srcas != "" {
+			listASes, err := parseASList(configFile.Srcas)
+			if err != nil {
+				return nil, err
+			}
+			ases = append(ases, listASes...)
+		}
+		if configFile.ASFile != "" {
+			fileASes, err := readASFile(configFile.ASFile)
+			if err != nil {
+				return nil, err
+			}
+			ases = append(ases, fileASes...)
+		}
+		srcFilt, err := filter.NewASFilterFromSlice(ases, filter.AS_SOURCE)
 		if err != nil {
 			return nil, err
 		}
@@ -169,6 +398,65 @@ func getFilters(configFile ConfigFile) ([]filter.Filter, error) {
 		filters = append(filters, anyFilt)
 	}
 
+	if configFile.ASPath != "" {
+		pathFilt, err := newASPathFilter(configFile.ASPath)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, pathFilt)
+	}
+
+	if configFile.MinPathLn != 0 || configFile.MaxPathLn != 0 {
+		lenFilt, err := newPathLenFilter(configFile.MinPathLn, configFile.MaxPathLn)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, lenFilt)
+	}
+
+	sessionFilters := []struct {
+		list  string
+		local bool
+		isIP  bool
+	}{
+		{configFile.PeerIP, false, true},
+		{configFile.PeerAS, false, false},
+		{configFile.LocalIP, true, true},
+		{configFile.LocalAS, true, false},
+	}
+	for _, sf := range sessionFilters {
+		if sf.list == "" {
+			continue
+		}
+		var sessFilt filter.Filter
+		var err error
+		if sf.isIP {
+			sessFilt, err = newSessionIPFilter(sf.list, sf.local)
+		} else {
+			sessFilt, err = newSessionASFilter(sf.list, sf.local)
+		}
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sessFilt)
+	}
+
+	if configFile.Community != "" {
+		commFilt, err := newCommunityFilter(configFile.Community, false)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, commFilt)
+	}
+
+	if configFile.LargeComm != "" {
+		lcommFilt, err := newCommunityFilter(configFile.LargeComm, true)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, lcommFilt)
+	}
+
 	loc := 0
 	switch configFile.PrefLoc {
 	case "advertized":
@@ -179,21 +467,64 @@ func getFilters(configFile ConfigFile) ([]filter.Filter, error) {
 		loc = filter.AnyPrefix
 	}
 
+	mode, err := parsePrefixMode(configFile.PrefMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefixes from the prefix file are added to the prefix list
+	var prefixes []string
 	if configFile.PrefList != "" {
-		prefFilt, err := filter.NewPrefixFilterFromString(configFile.PrefList, ",", loc)
+		prefixes = strings.Split(configFile.PrefList, ",")
+	}
+	if configFile.PrefFile != "" {
+		filePrefixes, err := readPrefixFile(configFile.PrefFile)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, filePrefixes...)
+	}
+
+	if len(prefixes) > 0 {
+		prefFilt, err := newPrefixFilterFromSlice(prefixes, loc, mode)
 		if err != nil {
 			return nil, err
 		}
 		filters = append(filters, prefFilt)
 	}
+
+	// The expression is combined with the other filters like any
+	// other filter
+	if configFile.Filter != "" {
+		exprFilt, err := ParseFilterExpr(configFile.Filter)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, exprFilt)
+	}
 	return filters, nil
 }
 
 // Consider putting this in format.go
-func getFormatter(configFile ConfigFile, dumpOut io.Writer) (fmtr Formatter) {
+func getFormatter(configFile ConfigFile, dumpOut io.Writer, resumed bool, rov *ROVValidator, bogons *BogonSet) (fmtr Formatter, err error) {
+	isMRT := configFile.Fmtr == "mrt" || configFile.Fmtr == "id"
+	if !isMRT && (configFile.Compress != "" || configFile.Reindex) {
+		return nil, fmt.Errorf("Output compression and reindexing need the mrt formatter")
+	}
+	// The mrt formatter writes whole records, without the prefixes
+	// these remove from a message
+	if isMRT {
+		if afi, _ := parseAFI(configFile.AFI); afi != afiAny {
+			return nil, fmt.Errorf("The mrt formatter can't be used with -afi")
+		}
+		if mode, _ := parseBogonMode(configFile.Bogons); mode == BogonsDrop {
+			return nil, fmt.Errorf("The mrt formatter can't be used with -bogons drop")
+		}
+	}
+
 	switch configFile.Fmtr {
 	case "json":
-		fmtr = NewJSONFormatter()
+		fmtr = NewJSONFormatter(rov, bogons)
 	case "pup":
 		fmtr = NewUniquePrefixList(dumpOut)
 	case "pts":
@@ -205,9 +536,18 @@ func getFormatter(configFile ConfigFile, dumpOut io.Writer) (fmtr Formatter) {
 	case "prefixlock":
 		fmtr = NewPrefixLockFormatter()
 	case "ml":
-		fmtr = NewMlFormatter()
-	case "id":
-		fmtr = NewIdentityFormatter()
+		fmtr = NewMlFormatter(rov, bogons)
+	case "bgpdump":
+		fmtr = NewBgpdumpFormatter()
+	case "csv":
+		// The output of a resumed dump has the header already
+		hdrOut := dumpOut
+		if resumed {
+			hdrOut = ioutil.Discard
+		}
+		fmtr, err = NewCSVFormatter(hdrOut, configFile.Fields, rov, bogons)
+	case "mrt", "id":
+		fmtr, err = NewMRTFormatter(dumpOut, configFile.Compress, configFile.Reindex)
 	case "asmap":
 		fmtr = NewASMapFormatter(dumpOut)
 	default:
@@ -254,15 +594,27 @@ func (sa *StringArray) Next() (string, error) {
 }
 
 type DirectorySource struct {
-	dirList  []string
-	curDir   int
-	fileList []os.FileInfo
-	curFile  int
-	mux      *sync.Mutex
+	dirList    []string
+	collectors []string // the collector of each directory, if known
+	curDir     int
+	fileList   []os.FileInfo
+	curFile    int
+	mux        *sync.Mutex
 }
 
 func NewDirectorySource(dirs []string) *DirectorySource {
-	return &DirectorySource{dirs, 0, nil, 0, &sync.Mutex{}}
+	return &DirectorySource{dirs, nil, 0, nil, 0, &sync.Mutex{}}
+}
+
+// Returns the collector of the directory a path returned by Next
+// is in. The lists are never changed, so this doesn't need the lock
+func (ds *DirectorySource) collector(path string) string {
+	for i, dir := range ds.dirList {
+		if i < len(ds.collectors) && strings.HasPrefix(path, dir) && !strings.Contains(path[len(dir):], "/") {
+			return ds.collectors[i]
+		}
+	}
+	return ""
 }
 
 func (ds *DirectorySource) Next() (string, error) {
@@ -338,6 +690,7 @@ func parseConfig(colfmt, config string) (ConfigFile, stringsource, error) {
 	}
 
 	paths := []string{}
+	cols := []string{}
 
 	// Start at start, increment by 1 months, until it's past 1 day
 	// past end, so end is included
@@ -353,10 +706,13 @@ func parseConfig(colfmt, config string) (ConfigFile, stringsource, error) {
 			// Remove all placeholders from the path
 			curPath = strings.Replace(curPath, "{yyyy.mm}", mon.Format("2006.01"), -1)
 			paths = append(paths, curPath)
+			cols = append(cols, col)
 		}
 	}
 
-	return cf, NewDirectorySource(paths), nil
+	ds := NewDirectorySource(paths)
+	ds.collectors = cols
+	return cf, ds, nil
 }
 
 func readCollectorFormat(fname string) (map[string]string, error) {
@@ -0,0 +1,358 @@
+// The csv formatter, which writes a row for every route of a message
+// under a header row of the selected fields. Values are quoted where
+// needed, so the output loads as it is into pandas, ClickHouse or a
+// spreadsheet. Fields are read directly from the buffer stack rather
+// than from its JSON, like the ml formatter does.
+
+package gobgpdump
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+)
+
+// The fields written when none are given
+const DefaultCSVFields = "timestamp,peer_ip,peer_as,type,prefix,as_path,origin_as,next_hop,communities"
+
+// One row of output: a route of an update or a RIB entry, or a
+// message without routes, like a state change
+type csvRow struct {
+	mbs     *mrt.MrtBufferStack
+	info    MBSInfo
+	typ     string
+	prefix  *mrt.Route
+	pathID  *uint32 // only with ADD-PATH
+	attrs   *pbbgp.BGPUpdate_Attributes
+	block   []byte // raw path attributes, for large communities
+	peer    *pbbgp.PeerEntry
+	localIP net.IP
+	localAS uint32
+	states  *stateTransition
+}
+
+// A field returns its value in a row, which is empty when the row
+// doesn't have it
+type csvField func(*CSVFormatter, *csvRow) string
+
+var csvFields = map[string]csvField{
+	// BGP4MP_ET messages have microseconds
+	"timestamp": func(_ *CSVFormatter, r *csvRow) string {
+		if _, ok := getMicroseconds(r.mbs); ok {
+			return getTimestamp(r.mbs).UTC().Format("2006-01-02 15:04:05.000000")
+		}
+		return mrt.GetTimestamp(r.mbs).UTC().Format("2006-01-02 15:04:05")
+	},
+	"unixtime": func(_ *CSVFormatter, r *csvRow) string {
+		if usec, ok := getMicroseconds(r.mbs); ok {
+			return fmt.Sprintf("%d.%06d", mrt.GetTimestamp(r.mbs).Unix(), usec)
+		}
+		return strconv.FormatInt(mrt.GetTimestamp(r.mbs).Unix(), 10)
+	},
+	"peer_ip": func(_ *CSVFormatter, r *csvRow) string {
+		if r.peer == nil || r.peer.Peer_IP == nil {
+			return ""
+		}
+		return net.IP(util.GetIP(r.peer.Peer_IP)).String()
+	},
+	"peer_as": func(_ *CSVFormatter, r *csvRow) string {
+		if r.peer == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(r.peer.Peer_AS), 10)
+	},
+	"local_ip": func(_ *CSVFormatter, r *csvRow) string {
+		if r.localIP == nil {
+			return ""
+		}
+		return r.localIP.String()
+	},
+	"local_as": func(_ *CSVFormatter, r *csvRow) string {
+		if r.localIP == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(r.localAS), 10)
+	},
+	"type": func(_ *CSVFormatter, r *csvRow) string {
+		return r.typ
+	},
+	"prefix": func(_ *CSVFormatter, r *csvRow) string {
+		if r.prefix == nil {
+			return ""
+		}
+		return fmt.Sprintf("%s/%d", r.prefix.IP, r.prefix.Mask)
+	},
+	"path_id": func(_ *CSVFormatter, r *csvRow) string {
+		if r.pathID == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(*r.pathID), 10)
+	},
+	"as_path": func(_ *CSVFormatter, r *csvRow) string {
+		if r.attrs == nil {
+			return ""
+		}
+		return asPathSegmentString(r.attrs.ASPath)
+	},
+	"origin_as": func(_ *CSVFormatter, r *csvRow) string {
+		if origin := getOriginAS(r.attrs); origin != 0 {
+			return strconv.FormatUint(uint64(origin), 10)
+		}
+		return ""
+	},
+	"next_hop": func(_ *CSVFormatter, r *csvRow) string {
+		if r.attrs == nil || r.attrs.NextHop == nil {
+			return ""
+		}
+		return net.IP(util.GetIP(r.attrs.NextHop)).String()
+	},
+	"origin": func(_ *CSVFormatter, r *csvRow) string {
+		if !hasAttr(r.attrs, pbbgp.BGPUpdate_Attributes_ORIGIN) {
+			return ""
+		}
+		if r.attrs.Origin == pbbgp.BGPUpdate_Attributes_INC {
+			return "INCOMPLETE"
+		}
+		return r.attrs.Origin.String()
+	},
+	"communities": func(_ *CSVFormatter, r *csvRow) string {
+		var strs []string
+		for _, com := range getCommunities(r.attrs) {
+			strs = append(strs, fmt.Sprintf("%d:%d", com[0], com[1]))
+		}
+		return strings.Join(strs, " ")
+	},
+	"large_communities": func(_ *CSVFormatter, r *csvRow) string {
+		var strs []string
+		for _, lcom := range getLargeCommunities(r.block) {
+			strs = append(strs, fmt.Sprintf("%d:%d:%d", lcom[0], lcom[1], lcom[2]))
+		}
+		return strings.Join(strs, " ")
+	},
+	"med": func(_ *CSVFormatter, r *csvRow) string {
+		if !hasAttr(r.attrs, pbbgp.BGPUpdate_Attributes_MULTI_EXIT) {
+			return ""
+		}
+		return strconv.FormatUint(uint64(r.attrs.MultiExit), 10)
+	},
+	"local_pref": func(_ *CSVFormatter, r *csvRow) string {
+		if !hasAttr(r.attrs, pbbgp.BGPUpdate_Attributes_LOCAL_PREF) {
+			return ""
+		}
+		return strconv.FormatUint(uint64(r.attrs.LocalPref), 10)
+	},
+	"old_state": func(_ *CSVFormatter, r *csvRow) string {
+		if r.states == nil {
+			return ""
+		}
+		return r.states.Old.String()
+	},
+	"new_state": func(_ *CSVFormatter, r *csvRow) string {
+		if r.states == nil {
+			return ""
+		}
+		return r.states.New.String()
+	},
+	"rov": func(c *CSVFormatter, r *csvRow) string {
+		if c.rov == nil || r.prefix == nil || r.attrs == nil {
+			return ""
+		}
+		return c.rov.Validate(r.prefix.IP, r.prefix.Mask, getOriginAS(r.attrs)).String()
+	},
+	"bogon": func(c *CSVFormatter, r *csvRow) string {
+		if c.bogons == nil || r.prefix == nil || r.attrs == nil {
+			return ""
+		}
+		return c.bogons.describe(*r.prefix, flattenASPath(r.attrs))
+	},
+	"collector": func(_ *CSVFormatter, r *csvRow) string {
+		return r.info.collector
+	},
+	"file": func(_ *CSVFormatter, r *csvRow) string {
+		return r.info.file
+	},
+	"msgnum": func(_ *CSVFormatter, r *csvRow) string {
+		return strconv.Itoa(r.info.msgNum)
+	},
+}
+
+// CSVFormatter writes the fields it was created with, in that order
+type CSVFormatter struct {
+	names  []string
+	fields []csvField
+	rov    *ROVValidator
+	bogons *BogonSet
+}
+
+// NewCSVFormatter checks a comma separated list of field names, and
+// writes the header row to fd. An empty list is DefaultCSVFields.
+func NewCSVFormatter(fd io.Writer, list string, rov *ROVValidator, bogons *BogonSet) (*CSVFormatter, error) {
+	if list == "" {
+		list = DefaultCSVFields
+	}
+	c := &CSVFormatter{rov: rov, bogons: bogons}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		field, ok := csvFields[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown csv field: %s", name)
+		}
+		c.names = append(c.names, name)
+		c.fields = append(c.fields, field)
+	}
+
+	// The header is written before any worker starts, so it is
+	// always the first line
+	cw := csv.NewWriter(fd)
+	cw.Write(c.names)
+	cw.Flush()
+	return c, cw.Error()
+}
+
+func (c *CSVFormatter) format(mbs *mrt.MrtBufferStack, info MBSInfo) (string, error) {
+	buf := &bytes.Buffer{}
+	cw := csv.NewWriter(buf)
+	for _, row := range c.rows(mbs, info) {
+		rec := make([]string, len(c.fields))
+		for i, field := range c.fields {
+			rec[i] = field(c, row)
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return buf.String(), cw.Error()
+}
+
+// Splits a message into rows. Updates have a row for each advertised
+// and withdrawn route, RIB messages have a row for each entry, and
+// every other message has a single row without a prefix.
+func (c *CSVFormatter) rows(mbs *mrt.MrtBufferStack, info MBSInfo) []*csvRow {
+	if mbs.IsRibStack() {
+		return ribRows(mbs, info)
+	}
+
+	base := csvRow{mbs: mbs, info: info}
+	if b4h, ok := mbs.Bgp4mpbuf.(pp.BGP4MPHeaderer); ok && b4h.GetHeader() != nil {
+		hdr := b4h.GetHeader()
+		base.peer = &pbbgp.PeerEntry{Peer_IP: hdr.Peer_IP, Peer_AS: hdr.Peer_AS}
+		if hdr.Local_IP != nil {
+			base.localIP, base.localAS = net.IP(util.GetIP(hdr.Local_IP)), hdr.Local_AS
+		}
+	}
+
+	if sc := getStateChange(mbs); sc != nil {
+		base.typ, base.states = "state", &sc.states
+		return []*csvRow{&base}
+	}
+	class := getMsgClass(mbs)
+	if class&msgUpdates == 0 {
+		base.typ = msgClassName(class)
+		return []*csvRow{&base}
+	}
+
+	if attrs := getAttrs(mbs); len(attrs) > 0 {
+		base.attrs = attrs[0]
+	}
+	if blocks := getRawAttrBlocks(mbs); len(blocks) > 0 {
+		base.block = blocks[0]
+	}
+	if class == MsgEndOfRIB {
+		base.typ = "eor"
+		return []*csvRow{&base}
+	}
+
+	var rows []*csvRow
+	ids := getMsgPathIDs(mbs, filter.AdvPrefix)
+	for i, pref := range getMsgPrefixes(mbs, filter.AdvPrefix) {
+		pref, row := pref, base
+		row.typ, row.prefix = "announce", &pref
+		if i < len(ids) {
+			row.pathID = &ids[i]
+		}
+		rows = append(rows, &row)
+	}
+	// Withdrawn routes have no attributes
+	ids = getMsgPathIDs(mbs, filter.WdrPrefix)
+	for i, pref := range getMsgPrefixes(mbs, filter.WdrPrefix) {
+		pref, row := pref, base
+		row.typ, row.prefix, row.attrs, row.block = "withdraw", &pref, nil, nil
+		if i < len(ids) {
+			row.pathID = &ids[i]
+		}
+		rows = append(rows, &row)
+	}
+	return rows
+}
+
+func ribRows(mbs *mrt.MrtBufferStack, info MBSInfo) []*csvRow {
+	ribh, ok := mbs.Ribbuf.(pp.RIBHeaderer)
+	if !ok || ribh.GetHeader() == nil {
+		return nil
+	}
+	ir, _ := mbs.Ribbuf.(*indexedRib)
+	blocks := getRawAttrBlocks(mbs)
+
+	var rows []*csvRow
+	for i, ent := range ribh.GetHeader().RouteEntry {
+		row := &csvRow{mbs: mbs, info: info, typ: "rib", attrs: ent.Attrs}
+		if ent.Prefix != nil && ent.Prefix.Prefix != nil {
+			pref := prefixRoute(ent.Prefix)
+			row.prefix = &pref
+		}
+		if ir != nil {
+			row.peer = ir.peer(ent)
+			// A split message has the path ID at its position
+			if j := ir.pos + i; j < len(ir.pathIDs) {
+				row.pathID = &ir.pathIDs[j]
+			}
+		}
+		if i < len(blocks) {
+			row.block = blocks[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// The csv formatter doesn't need to summarize
+func (c *CSVFormatter) summarize() {}
+
+func (c *CSVFormatter) formatsInParallel() {}
+
+// Writes an AS path with its segments, unlike asPathString, so AS_SETs
+// are kept apart: "3356 174 {64500,64501}"
+func asPathSegmentString(segs []*pbbgp.BGPUpdate_ASPathSegment) string {
+	var strs []string
+	for _, seg := range segs {
+		if len(seg.ASSeq) > 0 {
+			strs = append(strs, asPathString(seg.ASSeq))
+		} else if len(seg.ASSet) > 0 {
+			strs = append(strs, "{"+strings.Replace(asPathString(seg.ASSet), " ", ",", -1)+"}")
+		}
+	}
+	return strings.Join(strs, " ")
+}
+
+// Returns whether a set of attributes has an attribute, for the
+// ones that can't be told apart from their zero value
+func hasAttr(attrs *pbbgp.BGPUpdate_Attributes, typ pbbgp.BGPUpdate_Attributes_Type) bool {
+	if attrs == nil {
+		return false
+	}
+	for _, t := range attrs.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+// Filter expressions, which combine filters with and, or and not.
+// An expression like
+//	srcas(3356) and not prefix(10.0.0.0/8) or community(*:666)
+// is parsed into a tree of filter.Filter values. not binds tightest,
+// then and, then or, and parentheses group as usual.
+
+package gobgpdump
+
+import (
+	"fmt"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Each function that can appear in an expression, and how to build
+// its filter from the text between the parentheses
+var exprFuncs = map[string]func(arg string) (filter.Filter, error){
+	"srcas":     asPositionFunc(filter.AS_SOURCE),
+	"destas":    asPositionFunc(filter.AS_DESTINATION),
+	"midas":     asPositionFunc(filter.AS_MIDPATH),
+	"anyas":     asPositionFunc(filter.AS_ANYWHERE),
+	"prefix":    prefixLocFunc(filter.AnyPrefix),
+	"advprefix": prefixLocFunc(filter.AdvPrefix),
+	"wdprefix":  prefixLocFunc(filter.WdrPrefix),
+	"peerip": func(arg string) (filter.Filter, error) {
+		return newSessionIPFilter(arg, false)
+	},
+	"peeras": func(arg string) (filter.Filter, error) {
+		return newSessionASFilter(arg, false)
+	},
+	"localip": func(arg string) (filter.Filter, error) {
+		return newSessionIPFilter(arg, true)
+	},
+	"localas": func(arg string) (filter.Filter, error) {
+		return newSessionASFilter(arg, true)
+	},
+	"community": func(arg string) (filter.Filter, error) {
+		return newCommunityFilter(arg, false)
+	},
+	"lcommunity": func(arg string) (filter.Filter, error) {
+		return newCommunityFilter(arg, true)
+	},
+	"aspath": newASPathFilter,
+	"minpathlen": func(arg string) (filter.Filter, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed path length: %s", arg)
+		}
+		return newPathLenFilter(n, 0)
+	},
+	"maxpathlen": func(arg string) (filter.Filter, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed path length: %s", arg)
+		}
+		return newPathLenFilter(0, n)
+	},
+	"time": func(arg string) (filter.Filter, error) {
+		// time(start,end), where either side may be empty
+		parts := strings.Split(arg, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("time takes a start and an end: time(%s)", arg)
+		}
+		tw, err := newTimeWindow(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		if err != nil || tw == nil {
+			return nil, fmt.Errorf("Malformed time window: time(%s)", arg)
+		}
+		return tw.filter, nil
+	},
+}
+
+func asPositionFunc(pos filter.ASPosition) func(string) (filter.Filter, error) {
+	return func(arg string) (filter.Filter, error) {
+		ases, err := parseASList(arg)
+		if err != nil {
+			return nil, err
+		}
+		return filter.NewASFilterFromSlice(ases, pos)
+	}
+}
+
+func prefixLocFunc(loc int) func(string) (filter.Filter, error) {
+	return func(arg string) (filter.Filter, error) {
+		return newPrefixFilter(arg, loc, PrefixOrLonger)
+	}
+}
+
+func andFilter(a, b filter.Filter) filter.Filter {
+	return func(mbs *mrt.MrtBufferStack) bool {
+		return a(mbs) && b(mbs)
+	}
+}
+
+func orFilter(a, b filter.Filter) filter.Filter {
+	return func(mbs *mrt.MrtBufferStack) bool {
+		return a(mbs) || b(mbs)
+	}
+}
+
+func notFilter(a filter.Filter) filter.Filter {
+	return func(mbs *mrt.MrtBufferStack) bool {
+		return !a(mbs)
+	}
+}
+
+// ParseFilterExpr parses a filter expression into a single filter
+func ParseFilterExpr(expr string) (filter.Filter, error) {
+	ep := &exprParser{expr: expr}
+	filt, err := ep.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	ep.skipSpace()
+	if ep.pos < len(ep.expr) {
+		return nil, ep.errorf("unexpected %q", ep.expr[ep.pos:])
+	}
+	return filt, nil
+}
+
+// A recursive descent parser over the expression string
+type exprParser struct {
+	expr string
+	pos  int
+}
+
+func (ep *exprParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("Filter expression at position %d: %s", ep.pos, fmt.Sprintf(format, a...))
+}
+
+func (ep *exprParser) skipSpace() {
+	for ep.pos < len(ep.expr) && unicode.IsSpace(rune(ep.expr[ep.pos])) {
+		ep.pos++
+	}
+}
+
+// Returns the next word without consuming it
+func (ep *exprParser) peekWord() string {
+	ep.skipSpace()
+	end := ep.pos
+	for end < len(ep.expr) && (unicode.IsLetter(rune(ep.expr[end])) || unicode.IsDigit(rune(ep.expr[end]))) {
+		end++
+	}
+	return strings.ToLower(ep.expr[ep.pos:end])
+}
+
+// Consumes the next word if it is the given keyword
+func (ep *exprParser) keyword(kw string) bool {
+	if ep.peekWord() != kw {
+		return false
+	}
+	ep.pos += len(kw)
+	return true
+}
+
+func (ep *exprParser) parseOr() (filter.Filter, error) {
+	left, err := ep.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for ep.keyword("or") {
+		right, err := ep.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orFilter(left, right)
+	}
+	return left, nil
+}
+
+func (ep *exprParser) parseAnd() (filter.Filter, error) {
+	left, err := ep.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for ep.keyword("and") {
+		right, err := ep.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andFilter(left, right)
+	}
+	return left, nil
+}
+
+func (ep *exprParser) parseNot() (filter.Filter, error) {
+	if ep.keyword("not") {
+		filt, err := ep.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter(filt), nil
+	}
+	return ep.parsePrimary()
+}
+
+// A parenthesized expression, or a function like srcas(1,2)
+func (ep *exprParser) parsePrimary() (filter.Filter, error) {
+	ep.skipSpace()
+	if ep.pos >= len(ep.expr) {
+		return nil, ep.errorf("unexpected end of expression")
+	}
+
+	if ep.expr[ep.pos] == '(' {
+		ep.pos++
+		filt, err := ep.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		ep.skipSpace()
+		if ep.pos >= len(ep.expr) || ep.expr[ep.pos] != ')' {
+			return nil, ep.errorf("missing )")
+		}
+		ep.pos++
+		return filt, nil
+	}
+
+	name := ep.peekWord()
+	newFilt, ok := exprFuncs[name]
+	if !ok {
+		if name == "" {
+			return nil, ep.errorf("unexpected %q", ep.expr[ep.pos:ep.pos+1])
+		}
+		return nil, ep.errorf("unknown filter %s", name)
+	}
+	ep.pos += len(name)
+	ep.skipSpace()
+	if ep.pos >= len(ep.expr) || ep.expr[ep.pos] != '(' {
+		return nil, ep.errorf("%s needs an argument in parentheses", name)
+	}
+
+	arg, err := ep.parseArg()
+	if err != nil {
+		return nil, err
+	}
+	filt, err := newFilt(arg)
+	if err != nil {
+		return nil, ep.errorf("%s", err)
+	}
+	return filt, nil
+}
+
+// Returns the text between the parentheses at the current position.
+// Parentheses inside the argument must be balanced, so an AS path
+// expression like aspath((_17806){3}) can be written as it is.
+func (ep *exprParser) parseArg() (string, error) {
+	start := ep.pos + 1
+	depth := 0
+	for ; ep.pos < len(ep.expr); ep.pos++ {
+		switch ep.expr[ep.pos] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				ep.pos++
+				return strings.TrimSpace(ep.expr[start : ep.pos-1]), nil
+			}
+		}
+	}
+	return "", ep.errorf("missing )")
+}
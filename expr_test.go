@@ -0,0 +1,146 @@
+package gobgpdump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+// Returns a BGP4MP_MESSAGE_AS4 record at time ts, announcing
+// 1.0.0.0/24 with the AS path 3356 174
+func testUpdate(ts uint32) []byte {
+	attrs := []byte{0x40, 1, 1, 0}                         // ORIGIN IGP
+	attrs = append(attrs, 0x40, 2, 10, 2, 2)               // AS_PATH, one AS_SEQUENCE of 2
+	attrs = append(attrs, 0, 0, 0x0d, 0x1c, 0, 0, 0, 0xae) // 3356 174
+	attrs = append(attrs, 0x40, 3, 4, 10, 0, 0, 1)         // NEXT_HOP
+	nlri := []byte{24, 1, 0, 0}
+
+	update := []byte{0, 0, byte(len(attrs) >> 8), byte(len(attrs))}
+	update = append(update, attrs...)
+	update = append(update, nlri...)
+	msg := append(bytes.Repeat([]byte{0xff}, 16), 0, 0, 2)
+	binary.BigEndian.PutUint16(msg[16:18], uint16(19+len(update)))
+	msg = append(msg, update...)
+
+	// Peer and local AS, interface, AFI, peer and local IP
+	body := []byte{0, 0, 0x0d, 0x1c, 0, 0, 0xfd, 0xe8, 0, 0, 0, 1, 10, 0, 0, 2, 10, 0, 0, 1}
+	body = append(body, msg...)
+	rec := make([]byte, 12, 12+len(body))
+	binary.BigEndian.PutUint32(rec[0:4], ts)
+	binary.BigEndian.PutUint16(rec[4:6], mrt.BGP4MP)
+	binary.BigEndian.PutUint16(rec[6:8], bgp4mpMessage4)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(body)))
+	return append(rec, body...)
+}
+
+// Adds the functions yes() and no(), which pass every message and
+// none, for as long as the test runs
+func addConstFuncs(t *testing.T) {
+	constant := func(pass bool) func(string) (filter.Filter, error) {
+		return func(string) (filter.Filter, error) {
+			return func(*mrt.MrtBufferStack) bool { return pass }, nil
+		}
+	}
+	exprFuncs["yes"] = constant(true)
+	exprFuncs["no"] = constant(false)
+	t.Cleanup(func() {
+		delete(exprFuncs, "yes")
+		delete(exprFuncs, "no")
+	})
+}
+
+func TestParseFilterExprLogic(t *testing.T) {
+	addConstFuncs(t)
+	tests := []struct {
+		expr string
+		pass bool
+	}{
+		{"yes()", true},
+		{"no()", false},
+		{"not no()", true},
+		{"not not no()", false},
+		{"yes() and no()", false},
+		{"yes() or no()", true},
+		// and binds tighter than or, and not tighter than and
+		{"yes() or yes() and no()", true},
+		{"no() and yes() or yes()", true},
+		{"not yes() and no()", false},
+		{"not yes() or yes()", true},
+		{"not (yes() and no())", true},
+		{"(yes() or yes()) and no()", false},
+		{"((no()) or (not no()))", true},
+		{"  YES()  AND  Not  no()  ", true},
+	}
+	for _, test := range tests {
+		filt, err := ParseFilterExpr(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if pass := filt(nil); pass != test.pass {
+			t.Errorf("%q: got %v, want %v", test.expr, pass, test.pass)
+		}
+	}
+}
+
+func TestParseFilterExprFuncs(t *testing.T) {
+	mbs, err := parseBGP4MP(testUpdate(1000))
+	if err != nil {
+		t.Fatalf("parsing the test update: %s", err)
+	}
+	tests := []struct {
+		expr string
+		pass bool
+	}{
+		{"srcas(174)", true},
+		{"srcas(3356, 174)", true},
+		{"srcas( 1 ,2 )", false},
+		{"destas(3356)", true},
+		{"anyas(1, 174)", true},
+		{"prefix(1.0.0.0/8)", true},
+		{"wdprefix(1.0.0.0/8)", false},
+		{"srcas(174) and not prefix(10.0.0.0/8)", true},
+		{"aspath(^3356 174$)", true},
+		{"aspath((_3356){2})", false},
+		{"time(,1000)", false},
+		{"time(1000,)", true},
+		{"time(999, 1001)", true},
+	}
+	for _, test := range tests {
+		filt, err := ParseFilterExpr(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if pass := filt(mbs); pass != test.pass {
+			t.Errorf("%q: got %v, want %v", test.expr, pass, test.pass)
+		}
+	}
+}
+
+func TestParseFilterExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"srcas",
+		"srcas(",
+		"srcas(x)",
+		"srcas(1,)",
+		"nosuch(1)",
+		"(srcas(1)",
+		"srcas(1))",
+		"srcas(1) and",
+		"srcas(1) or or srcas(2)",
+		"not",
+		"srcas(1) srcas(2)",
+		"time(1000)",
+		"time(,)",
+		"minpathlen(x)",
+	} {
+		if _, err := ParseFilterExpr(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Filters defined by gobgpdump, in addition to the ones in
+// protoparse/filter. They all return a filter.Filter, so they
+// can be mixed freely with the protoparse filters.
+
+package gobgpdump
+
+import (
+	"fmt"
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A window of time over MRT timestamps. A zero start or end
+// leaves that side of the window open
+type timeWindow struct {
+	start time.Time // inclusive
+	end   time.Time // exclusive
+}
+
+func newTimeWindow(start, end string) (*timeWindow, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+
+	tw := &timeWindow{}
+	var err error
+	if start != "" {
+		if tw.start, err = parseTimeArg(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != "" {
+		if tw.end, err = parseTimeArg(end); err != nil {
+			return nil, err
+		}
+	}
+	if !tw.start.IsZero() && !tw.end.IsZero() && !tw.start.Before(tw.end) {
+		return nil, fmt.Errorf("Start time %s is not before end time %s", start, end)
+	}
+	return tw, nil
+}
+
+// Accepts either an RFC3339 time or a unix timestamp. Both may have
+// fractions of a second, down to the microseconds of BGP4MP_ET
+func parseTimeArg(str string) (time.Time, error) {
+	secs, frac := str, ""
+	if dot := strings.IndexByte(str, '.'); dot >= 0 {
+		secs, frac = str[:dot], str[dot+1:]
+	}
+	if unix, err := strconv.ParseInt(secs, 10, 64); err == nil {
+		nsec, err := parseFraction(frac)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Time %s is neither RFC3339 nor a unix timestamp", str)
+		}
+		return time.Unix(unix, nsec), nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return t, fmt.Errorf("Time %s is neither RFC3339 nor a unix timestamp", str)
+	}
+	return t, nil
+}
+
+// Returns the nanoseconds in the digits after the decimal point of
+// a timestamp
+func parseFraction(frac string) (int64, error) {
+	if frac == "" {
+		return 0, nil
+	}
+	if len(frac) > 9 {
+		return 0, fmt.Errorf("Too many digits in %s", frac)
+	}
+	nsec, err := strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 32)
+	return int64(nsec), err
+}
+
+func (tw *timeWindow) contains(t time.Time) bool {
+	if !tw.start.IsZero() && t.Before(tw.start) {
+		return false
+	}
+	return !tw.isPast(t)
+}
+
+// Returns true if t is after the end of the window
+func (tw *timeWindow) isPast(t time.Time) bool {
+	return !tw.end.IsZero() && !t.Before(tw.end)
+}
+
+// How far past the end of the window the timestamps of a file must
+// be before reading stops, so messages written slightly out of order
+// at the end of the window are still read
+const pastEndSlack = 5 * time.Minute
+
+// Returns true if t is after the end of the window by at least
+// pastEndSlack
+func (tw *timeWindow) isWellPast(t time.Time) bool {
+	return !tw.end.IsZero() && !t.Before(tw.end.Add(pastEndSlack))
+}
+
+func (tw *timeWindow) filter(mbs *mrt.MrtBufferStack) bool {
+	return tw.contains(getTimestamp(mbs))
+}
+
+// Filters messages by the BGP session they were captured on. For
+// BGP4MP messages that is the BGP4MP header, for RIB entries it is
+// the peer in the PEER_INDEX_TABLE. The index table only describes
+// peers, so RIB entries never pass a filter on the local side.
+type sessionFilter struct {
+	local bool
+	nets  []*net.IPNet
+	ases  []uint32
+}
+
+// Returns a filter on the peer (or local) IP of a session. The list
+// is comma separated, and may contain addresses or prefixes
+func newSessionIPFilter(list string, local bool) (filter.Filter, error) {
+	sf := sessionFilter{local: local}
+	for _, str := range strings.Split(list, ",") {
+		str = strings.TrimSpace(str)
+		if !strings.Contains(str, "/") {
+			if strings.Contains(str, ":") {
+				str += "/128"
+			} else {
+				str += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed IP address in session filter: %s", str)
+		}
+		sf.nets = append(sf.nets, ipnet)
+	}
+	return sf.filter, nil
+}
+
+// Returns a filter on the peer (or local) AS of a session, from
+// a comma separated list of AS numbers
+func newSessionASFilter(list string, local bool) (filter.Filter, error) {
+	ases, err := parseASList(list)
+	if err != nil {
+		return nil, err
+	}
+	return sessionFilter{local: local, ases: ases}.filter, nil
+}
+
+func (sf sessionFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	if mbs.IsRibStack() {
+		if sf.local {
+			return false
+		}
+		for _, peer := range getRibPeers(mbs.Ribbuf) {
+			if sf.matches(peer.Peer_IP, peer.Peer_AS) {
+				return true
+			}
+		}
+		return false
+	}
+
+	b4h, ok := mbs.Bgp4mpbuf.(pp.BGP4MPHeaderer)
+	if !ok || b4h.GetHeader() == nil {
+		return false
+	}
+	hdr := b4h.GetHeader()
+	if sf.local {
+		return sf.matches(hdr.Local_IP, hdr.Local_AS)
+	}
+	return sf.matches(hdr.Peer_IP, hdr.Peer_AS)
+}
+
+func (sf sessionFilter) matches(ip *pbcom.IPAddressWrapper, as uint32) bool {
+	if sf.nets == nil {
+		for _, fas := range sf.ases {
+			if fas == as {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ip == nil {
+		return false
+	}
+	addr := net.IP(util.GetIP(ip))
+	for _, ipnet := range sf.nets {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a comma separated list of AS numbers, like "1,2,3,4"
+func parseASList(list string) ([]uint32, error) {
+	var ases []uint32
+	for _, str := range strings.Split(list, ",") {
+		as, err := strconv.ParseUint(strings.TrimSpace(str), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed AS number: %s", str)
+		}
+		ases = append(ases, uint32(as))
+	}
+	return ases, nil
+}
+
+// Well known communities that can be used by name in a community filter
+var wellKnownCommunities = map[string]string{
+	"graceful-shutdown":   "65535:0",
+	"blackhole":           "65535:666",
+	"no-export":           "65535:65281",
+	"no-advertise":        "65535:65282",
+	"no-export-subconfed": "65535:65283",
+}
+
+// A community to match, with -1 in place of a * wildcard
+type communityPattern []int64
+
+func (cp communityPattern) matches(vals []uint32) bool {
+	for i, part := range cp {
+		if part != -1 && uint32(part) != vals[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a comma separated list of communities with the given
+// number of parts, like "3356:666,*:666" or "65000:1:*"
+func parseCommunityPatterns(list string, nparts int) ([]communityPattern, error) {
+	var patterns []communityPattern
+	for _, str := range strings.Split(list, ",") {
+		str = strings.TrimSpace(str)
+		if wk, ok := wellKnownCommunities[strings.ToLower(str)]; ok && nparts == 2 {
+			str = wk
+		}
+		parts := strings.Split(str, ":")
+		if len(parts) != nparts {
+			return nil, fmt.Errorf("Malformed community: %s", str)
+		}
+		cp := make(communityPattern, nparts)
+		for i, part := range parts {
+			if part == "*" {
+				cp[i] = -1
+				continue
+			}
+			bits := 32
+			if nparts == 2 {
+				bits = 16
+			}
+			val, err := strconv.ParseUint(part, 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("Malformed community: %s", str)
+			}
+			cp[i] = int64(val)
+		}
+		patterns = append(patterns, cp)
+	}
+	return patterns, nil
+}
+
+// Passes messages with any community (or large community) that
+// matches one of the patterns. RIB messages pass if any of their
+// entries has one.
+type communityFilter struct {
+	patterns []communityPattern
+	large    bool
+}
+
+func newCommunityFilter(list string, large bool) (filter.Filter, error) {
+	nparts := 2
+	if large {
+		nparts = 3
+	}
+	patterns, err := parseCommunityPatterns(list, nparts)
+	if err != nil {
+		return nil, err
+	}
+	return communityFilter{patterns, large}.filter, nil
+}
+
+func (cf communityFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	if cf.large {
+		for _, block := range getRawAttrBlocks(mbs) {
+			for _, lc := range getLargeCommunities(block) {
+				if cf.matches(lc[:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, attrs := range getAttrs(mbs) {
+		for _, c := range getCommunities(attrs) {
+			if cf.matches(c[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cf communityFilter) matches(vals []uint32) bool {
+	for _, cp := range cf.patterns {
+		if cp.matches(vals) {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes messages with an AS path that matches a regular expression.
+// The path is written as AS numbers separated by spaces, and _ in the
+// expression matches the start or end of the path or the space between
+// two AS numbers, like in Cisco and Juniper AS path expressions.
+// A RIB message passes if the path of any of its entries matches.
+type asPathFilter struct {
+	re *regexp.Regexp
+}
+
+// Everything that _ stands for in an AS path expression
+const asPathDelim = `(^| |$)`
+
+func newASPathFilter(expr string) (filter.Filter, error) {
+	re, err := regexp.Compile(strings.Replace(expr, "_", asPathDelim, -1))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed AS path expression %s: %s", expr, err)
+	}
+	return asPathFilter{re}.filter, nil
+}
+
+func (af asPathFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	for _, path := range getASPaths(mbs) {
+		if af.re.MatchString(asPathString(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func asPathString(path []uint32) string {
+	strs := make([]string, len(path))
+	for i, as := range path {
+		strs[i] = strconv.FormatUint(uint64(as), 10)
+	}
+	return strings.Join(strs, " ")
+}
+
+// Passes messages with an AS path of at least min and at most max
+// AS numbers. Prepended AS numbers are counted every time they
+// appear. A max of 0 leaves the length unbounded. Messages without
+// an AS path, like pure withdrawals, never pass.
+type pathLenFilter struct {
+	min, max int
+}
+
+func newPathLenFilter(min, max int) (filter.Filter, error) {
+	if min < 0 || max < 0 || (max != 0 && min > max) {
+		return nil, fmt.Errorf("Invalid AS path length range: %d to %d", min, max)
+	}
+	return pathLenFilter{min, max}.filter, nil
+}
+
+func (pf pathLenFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	for _, path := range getASPaths(mbs) {
+		if len(path) >= pf.min && (pf.max == 0 || len(path) <= pf.max) {
+			return true
+		}
+	}
+	return false
+}
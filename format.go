@@ -3,7 +3,7 @@
 // Current formatters:
 // -TextFormatter
 // -JSONFormatter
-// -IdentityFormatter - Rename to MRTFormatter?
+// -MRTFormatter, in mrtwriter.go
 
 // These both need new configuration names
 // -UniquePrefixList
@@ -16,32 +16,42 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/CSUNetSec/protoparse/filter"
 	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
-	util "github.com/CSUNetSec/protoparse/util"
 	radix "github.com/armon/go-radix"
 )
 
 // A Formatter takes the bufferstack and the underlying buffer
 // and returns a representation of the data to be written to the
 // dump file.
-// The underlying buffer is necessary for the ID formatter
+// The underlying buffer is necessary for the MRT formatter
 type Formatter interface {
 	format(*mrt.MrtBufferStack, MBSInfo) (string, error)
 	summarize()
 }
 
+// A Formatter that doesn't depend on the order of the messages, so the
+// messages of a file can be formatted by the workers parsing it. Other
+// formatters get the messages of a file one at a time, in file order
+type parallelFormatter interface {
+	Formatter
+	formatsInParallel()
+}
+
 // This contains miscellaneous info for the MBS structure
 type MBSInfo struct {
-	file   string
-	msgNum int
+	file      string
+	msgNum    int
+	collector string // only known with the -conf option
 }
 
 func NewMBSInfo(file string, msg int) MBSInfo {
-	return MBSInfo{file, msg}
+	return MBSInfo{file: file, msgNum: msg}
 }
 
 // A simple text representation for the dump.
@@ -55,13 +65,19 @@ func NewTextFormatter() *TextFormatter {
 }
 
 func (t *TextFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
-	ret := fmt.Sprintf("[%d] MRT Header: %s\n", t.msgNum, mbs.MrthBuf)
+	ret := fmt.Sprintf("[%d] MRT Header: %s\n", t.msgNum, outputStack(mbs).MrthBuf)
 	if mbs.IsRibStack() {
 		ret += fmt.Sprintf("RIB Header: %s\n", mbs.Ribbuf)
+	} else if sc := getStateChange(mbs); sc != nil {
+		ret += fmt.Sprintf("BGP4MP Header: %s\n", mbs.Bgp4mpbuf)
+		ret += fmt.Sprintf("State Change: %s\n\n", sc.states)
 	} else {
 		ret += fmt.Sprintf("BGP4MP Header: %s\n", mbs.Bgp4mpbuf)
 		ret += fmt.Sprintf("BGP Header: %s\n", mbs.Bgphbuf)
-		ret += fmt.Sprintf("BGP Update: %s\n\n", mbs.Bgpupbuf)
+		if bgpMsgType(mbs) == bgpUpdate {
+			ret += fmt.Sprintf("BGP Update: %s\n", mbs.Bgpupbuf)
+		}
+		ret += "\n"
 	}
 	t.msgNum++
 	return ret, nil
@@ -70,6 +86,15 @@ func (t *TextFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, erro
 // The text formatter doesn't need to summarize
 func (t *TextFormatter) summarize() {}
 
+// The message numbers of a resumed dump carry on from the checkpoint
+func (t *TextFormatter) saveState() (interface{}, error) {
+	return t.msgNum, nil
+}
+
+func (t *TextFormatter) loadState(data json.RawMessage) error {
+	return json.Unmarshal(data, &t.msgNum)
+}
+
 // PrefixLock formatter keeps track of a prefix and the AS that advertized it.
 // It then "locks" that relation. In case the same prefix (exactly the same for now)
 // is advertized by some other AS, it outputs that event.
@@ -129,11 +154,53 @@ func (p *PrefixLockFormatter) registerPrefixAS(pref string, as uint32, t time.Ti
 
 func (p *PrefixLockFormatter) summarize() {}
 
+// An asEvent as saved in a checkpoint
+type savedASEvent struct {
+	AS   uint32
+	Time time.Time
+}
+
+type savedASLock struct {
+	Owner  savedASEvent
+	Others []savedASEvent `json:",omitempty"`
+}
+
+func (p *PrefixLockFormatter) saveState() (interface{}, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	state := make(map[string]savedASLock, len(p.plmap))
+	for pref, al := range p.plmap {
+		sl := savedASLock{Owner: savedASEvent{al.owner.as, al.owner.t}}
+		for _, ev := range al.others {
+			sl.Others = append(sl.Others, savedASEvent{ev.as, ev.t})
+		}
+		state[pref] = sl
+	}
+	return state, nil
+}
+
+func (p *PrefixLockFormatter) loadState(data json.RawMessage) error {
+	var state map[string]savedASLock
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	for pref, sl := range state {
+		al := newAsLock(sl.Owner.AS, sl.Owner.Time)
+		for _, ev := range sl.Others {
+			al.others = append(al.others, asEvent{ev.AS, ev.Time})
+		}
+		p.plmap[pref] = al
+	}
+	return nil
+}
+
 func (p *PrefixLockFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
 	eventstrs := []string(nil)
-	advRoutes, merr := mrt.GetAdvertisedPrefixes(mbs)
+	advRoutes := getMsgPrefixes(mbs, filter.AdvPrefix)
 	asp, errasp := mrt.GetASPath(mbs)
-	if errasp != nil || len(asp) == 0 || merr != nil {
+	if errasp != nil || len(asp) == 0 || len(advRoutes) == 0 {
 		//maybe just a withdrawn message? don't output anything
 		return "", nil
 	}
@@ -153,23 +220,77 @@ func (p *PrefixLockFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string
 	return "", nil
 }
 
-// Formats each update as a JSON message
-type JSONFormatter struct{}
+// Formats each update as a JSON message. State changes get a
+// "state_change" field with the old and new state. If rov is not nil,
+// every message with announcements gets an "rov" field with the RPKI
+// validation state of each of them. If bogons is not nil, messages
+// with bogon prefixes or reserved AS numbers get a "bogons" field
+type JSONFormatter struct {
+	rov    *ROVValidator
+	bogons *BogonSet
+}
 
-func NewJSONFormatter() JSONFormatter {
-	return JSONFormatter{}
+func NewJSONFormatter(rov *ROVValidator, bogons *BogonSet) JSONFormatter {
+	return JSONFormatter{rov, bogons}
 }
 
 func (j JSONFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
-	mbsj, err := json.Marshal(mbs)
-	return string(mbsj) + "\n", err
+	out := outputStack(mbs)
+	if !mbs.IsRibStack() && bgpMsgType(mbs) != bgpUpdate {
+		// Only updates have an update to show
+		out = &mrt.MrtBufferStack{MrthBuf: out.MrthBuf, Bgp4mpbuf: mbs.Bgp4mpbuf, Bgphbuf: mbs.Bgphbuf}
+	}
+	mbsj, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	if sc := getStateChange(mbs); sc != nil {
+		if mbsj, err = addJSONField(mbsj, "state_change", sc.states); err != nil {
+			return "", err
+		}
+	}
+	if j.rov != nil {
+		if results := j.rov.validateMsg(mbs); results != nil {
+			if mbsj, err = addJSONField(mbsj, "rov", results); err != nil {
+				return "", err
+			}
+		}
+	}
+	if j.bogons != nil {
+		if result := j.bogons.check(mbs); result != nil {
+			if mbsj, err = addJSONField(mbsj, "bogons", result); err != nil {
+				return "", err
+			}
+		}
+	}
+	return string(mbsj) + "\n", nil
+}
+
+// Adds a field to the end of a marshalled JSON object, leaving the
+// order of the other fields alone
+func addJSONField(obj []byte, name string, val interface{}) ([]byte, error) {
+	valj, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	end := len(obj) - 1
+	if end < 1 || obj[end] != '}' {
+		return nil, fmt.Errorf("Can't add %s to a JSON value that is not an object", name)
+	}
+	field := fmt.Sprintf("%q:%s}", name, valj)
+	if end > 1 {
+		field = "," + field
+	}
+	return append(obj[:end:end], field...), nil
 }
 
 // The JSON formatter doesn't need to summarize
 func (j JSONFormatter) summarize() {}
 
-func NewMlFormatter() mlFormatter {
-	return mlFormatter{}
+func (j JSONFormatter) formatsInParallel() {}
+
+func NewMlFormatter(rov *ROVValidator, bogons *BogonSet) mlFormatter {
+	return mlFormatter{rov, bogons}
 }
 
 type mltext struct {
@@ -184,9 +305,10 @@ type mltext struct {
 	}
 	Bgp_update struct {
 		Advertized_routes []struct {
-			Prefix string
-			Mask   int
-		}
+			Prefix  string
+			Mask    int
+			Path_id *uint32
+		} `json:"advertised_routes"`
 		Attrs struct {
 			AS_path []struct {
 				AS_seq []int
@@ -195,16 +317,25 @@ type mltext struct {
 			Next_hop string
 		}
 		Withdrawn_routes []struct {
-			Prefix string
-			Mask   int
+			Prefix  string
+			Mask    int
+			Path_id *uint32
 		}
 	}
 }
 
-type mlFormatter struct{}
+// Formats each route of an update as a line of comma separated
+// values. If rov is not nil, a column is added with the RPKI
+// validation state of advertised routes. If bogons is not nil, a
+// column is added that flags bogon prefixes and reserved AS numbers.
+// Routes of ADD-PATH updates have their path ID in a last column
+type mlFormatter struct {
+	rov    *ROVValidator
+	bogons *BogonSet
+}
 
 func (m mlFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
-	mbsj, err := json.Marshal(mbs)
+	mbsj, err := json.Marshal(outputStack(mbs))
 	if err != nil {
 		return "", err
 	}
@@ -219,6 +350,14 @@ func (m mlFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error)
 	}
 	t1parts := strings.Split(tparts[1], "Z")
 	retstr := ""
+	origin := uint32(0)
+	if attrs := getAttrs(mbs); m.rov != nil && len(attrs) > 0 {
+		origin = getOriginAS(attrs[0])
+	}
+	var path []uint32
+	if paths := getASPaths(mbs); m.bogons != nil && len(paths) > 0 {
+		path = paths[0]
+	}
 	for _, ar := range mtext.Bgp_update.Advertized_routes {
 		aspstr := ""
 		for _, asp := range mtext.Bgp_update.Attrs.AS_path {
@@ -237,37 +376,43 @@ func (m mlFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error)
 				}
 			}
 		}
-		retstr += fmt.Sprintf("%s,%s,%d,%d,%s,%s,%s,%s,%d,%s,%s\n", tparts[0], t1parts[0], mtext.Bgp4mp_header.Local_AS,
+		retstr += fmt.Sprintf("%s,%s,%d,%d,%s,%s,%s,%s,%d,%s,%s", tparts[0], t1parts[0], mtext.Bgp4mp_header.Local_AS,
 			mtext.Bgp4mp_header.Peer_AS, mtext.Bgp4mp_header.Local_IP, mtext.Bgp4mp_header.Peer_IP,
 			"advertized", ar.Prefix, ar.Mask, aspstr,
 			mtext.Bgp_update.Attrs.Next_hop)
+		if m.rov != nil {
+			retstr += "," + m.rov.Validate(net.ParseIP(ar.Prefix), uint8(ar.Mask), origin).String()
+		}
+		if m.bogons != nil {
+			retstr += "," + m.bogons.describe(mrt.Route{IP: net.ParseIP(ar.Prefix), Mask: uint8(ar.Mask)}, path)
+		}
+		if ar.Path_id != nil {
+			retstr += fmt.Sprintf(",%d", *ar.Path_id)
+		}
+		retstr += "\n"
 	}
 	for _, wr := range mtext.Bgp_update.Withdrawn_routes {
-		retstr += fmt.Sprintf("%s,%s,%d,%d,%s,%s,%s,%s,%d,%s,%s\n", tparts[0], t1parts[0], mtext.Bgp4mp_header.Local_AS,
+		retstr += fmt.Sprintf("%s,%s,%d,%d,%s,%s,%s,%s,%d,%s,%s", tparts[0], t1parts[0], mtext.Bgp4mp_header.Local_AS,
 			mtext.Bgp4mp_header.Peer_AS, mtext.Bgp4mp_header.Local_IP, mtext.Bgp4mp_header.Peer_IP,
 			"withdrawn", wr.Prefix, wr.Mask, "",
 			"")
+		if m.rov != nil {
+			retstr += ","
+		}
+		if m.bogons != nil {
+			retstr += ","
+		}
+		if wr.Path_id != nil {
+			retstr += fmt.Sprintf(",%d", *wr.Path_id)
+		}
+		retstr += "\n"
 	}
 	return retstr, nil
 }
 
 func (m mlFormatter) summarize() {}
 
-// Applies no formatting to the data
-// But data is decompressed, may need to fix that
-// However, golang bz2 doesn't have compression features
-type IdentityFormatter struct{}
-
-func NewIdentityFormatter() IdentityFormatter {
-	return IdentityFormatter{}
-}
-
-func (id IdentityFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
-	return string(mbs.GetRawMessage()), nil
-}
-
-// No summarization needed
-func (id IdentityFormatter) summarize() {}
+func (m mlFormatter) formatsInParallel() {}
 
 type PrefixHistory struct {
 	Pref   string
@@ -299,6 +444,37 @@ type PrefixEvent struct {
 	ASPath     []uint32
 }
 
+// A PrefixHistory as saved in a checkpoint, with the file and message
+// it was first seen in
+type savedPrefix struct {
+	Pref   string
+	File   string
+	MsgNum int
+	Events []PrefixEvent
+}
+
+// Returns the prefix map of pup or pts to save in a checkpoint
+func savePrefixes(pm map[string]interface{}) map[string]savedPrefix {
+	state := make(map[string]savedPrefix, len(pm))
+	for key, value := range pm {
+		ph := value.(*PrefixHistory)
+		state[key] = savedPrefix{ph.Pref, ph.info.file, ph.info.msgNum, ph.Events}
+	}
+	return state
+}
+
+// Adds the prefixes saved by savePrefixes to a prefix map
+func loadPrefixes(data json.RawMessage, pm map[string]interface{}) error {
+	var state map[string]savedPrefix
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for key, sp := range state {
+		pm[key] = &PrefixHistory{sp.Pref, NewMBSInfo(sp.File, sp.MsgNum), sp.Events}
+	}
+	return nil
+}
+
 // In original gobgpdump, the List and Series are the same struct.
 // Consider two separate structs
 
@@ -321,22 +497,15 @@ func NewUniquePrefixList(fd io.Writer) *UniquePrefixList {
 func (upl *UniquePrefixList) format(mbs *mrt.MrtBufferStack, inf MBSInfo) (string, error) {
 
 	timestamp := mrt.GetTimestamp(mbs)
-	advRoutes, err := mrt.GetAdvertisedPrefixes(mbs)
 	asp, errasp := mrt.GetASPath(mbs)
 	if errasp != nil || len(asp) == 0 {
 		//maybe just a withdrawn message? make it empty.
 		asp = []uint32{}
 	}
-	// Do something with routes only if there is no error.
-	// Otherwise, move on to withdrawn routes
-	if err == nil {
-		upl.addRoutes(advRoutes, inf, timestamp, true, asp)
-	}
-
-	wdnRoutes, err := mrt.GetWithdrawnPrefixes(mbs)
-	if err == nil {
-		upl.addRoutes(wdnRoutes, inf, timestamp, false, asp)
-	}
+	// Prefixes from MP_REACH_NLRI and MP_UNREACH_NLRI are in
+	// these lists too
+	upl.addRoutes(getMsgPrefixes(mbs, filter.AdvPrefix), inf, timestamp, true, asp)
+	upl.addRoutes(getMsgPrefixes(mbs, filter.WdrPrefix), inf, timestamp, false, asp)
 	return "", nil
 }
 
@@ -345,12 +514,9 @@ func (upl *UniquePrefixList) format(mbs *mrt.MrtBufferStack, inf MBSInfo) (strin
 // timestamp, it replaces the old one.
 func (upl *UniquePrefixList) addRoutes(rts []mrt.Route, info MBSInfo, timestamp time.Time, advert bool, asp []uint32) {
 	for _, route := range rts {
-		// Ignore this prefix, because it causes a lot of problems
-		if route.Mask == 1 {
-			continue
-		}
-
-		key := util.IPToRadixkey(route.IP, route.Mask)
+		// Keys carry the address family, so an IPv4 prefix
+		// never covers an IPv6 one in deleteChildPrefixes
+		key := prefixKey(route.IP, route.Mask)
 		if key == "" {
 			continue
 		}
@@ -379,6 +545,18 @@ func (upl *UniquePrefixList) summarize() {
 	}
 }
 
+func (upl *UniquePrefixList) saveState() (interface{}, error) {
+	upl.mux.Lock()
+	defer upl.mux.Unlock()
+	return savePrefixes(upl.prefixes), nil
+}
+
+func (upl *UniquePrefixList) loadState(data json.RawMessage) error {
+	upl.mux.Lock()
+	defer upl.mux.Unlock()
+	return loadPrefixes(data, upl.prefixes)
+}
+
 // UniquePrefixSeries does the same thing as UniquePrefixList, but
 // rather than just a list, it will output a gob file containing each
 // prefix and every event seen associated with that prefix
@@ -399,31 +577,19 @@ func NewUniquePrefixSeries(fd io.Writer) *UniquePrefixSeries {
 func (ups *UniquePrefixSeries) format(mbs *mrt.MrtBufferStack, inf MBSInfo) (string, error) {
 	timestamp := mrt.GetTimestamp(mbs)
 
-	advRoutes, err := mrt.GetAdvertisedPrefixes(mbs)
 	asp, errasp := mrt.GetASPath(mbs)
 	if errasp != nil || len(asp) == 0 {
 		//maybe just a withdrawn message? make it empty.
 		asp = []uint32{}
 	}
-	if err == nil {
-		ups.addRoutes(advRoutes, inf, timestamp, true, asp)
-	}
-
-	wdnRoutes, err := mrt.GetWithdrawnPrefixes(mbs)
-	if err == nil {
-		ups.addRoutes(wdnRoutes, inf, timestamp, false, asp)
-	}
+	ups.addRoutes(getMsgPrefixes(mbs, filter.AdvPrefix), inf, timestamp, true, asp)
+	ups.addRoutes(getMsgPrefixes(mbs, filter.WdrPrefix), inf, timestamp, false, asp)
 	return "", nil
 }
 
 func (ups *UniquePrefixSeries) addRoutes(rts []mrt.Route, info MBSInfo, timestamp time.Time, advert bool, asp []uint32) {
 	for _, route := range rts {
-		//This route causes a lot of trouble
-		if route.Mask == 1 {
-			continue
-		}
-
-		key := util.IPToRadixkey(route.IP, route.Mask)
+		key := prefixKey(route.IP, route.Mask)
 		if key == "" {
 			continue
 		}
@@ -454,6 +620,18 @@ func (ups *UniquePrefixSeries) summarize() {
 	}
 }
 
+func (ups *UniquePrefixSeries) saveState() (interface{}, error) {
+	ups.mux.Lock()
+	defer ups.mux.Unlock()
+	return savePrefixes(ups.prefixes), nil
+}
+
+func (ups *UniquePrefixSeries) loadState(data json.RawMessage) error {
+	ups.mux.Lock()
+	defer ups.mux.Unlock()
+	return loadPrefixes(data, ups.prefixes)
+}
+
 type PrefixWalker struct {
 	top      bool
 	prefixes map[string]interface{}
@@ -505,6 +683,22 @@ func (d *DayFormatter) summarize() {
 	}
 }
 
+func (d *DayFormatter) saveState() (interface{}, error) {
+	return d.hourCt, nil
+}
+
+func (d *DayFormatter) loadState(data json.RawMessage) error {
+	var hourCt []int
+	if err := json.Unmarshal(data, &hourCt); err != nil {
+		return err
+	}
+	if len(hourCt) != len(d.hourCt) {
+		return fmt.Errorf("Expected %d hour counts, got %d", len(d.hourCt), len(hourCt))
+	}
+	d.hourCt = hourCt
+	return nil
+}
+
 type ASNode struct {
 	as       uint32
 	ct       int
@@ -636,3 +830,45 @@ func (asmf *ASMapFormatter) summarize() {
 
 	asmf.asMap.ToDotFile(asmf.output)
 }
+
+// An ASNode as saved in a checkpoint
+type savedASNode struct {
+	Count  int
+	Next   []uint32 `json:",omitempty"`
+	Origin bool     `json:",omitempty"`
+}
+
+// The paths waiting for processPaths are added to the map before it is
+// saved, then it is started again
+func (asmf *ASMapFormatter) saveState() (interface{}, error) {
+	close(asmf.pathC)
+	asmf.wg.Wait()
+
+	state := make(map[uint32]savedASNode, len(asmf.asMap.nodes))
+	for as, node := range asmf.asMap.nodes {
+		state[as] = savedASNode{node.ct, node.next, node.isOrigin}
+	}
+
+	asmf.pathC = make(chan []uint32, 32)
+	asmf.wg.Add(1)
+	go asmf.processPaths()
+	return state, nil
+}
+
+// This is only called before any path is sent to processPaths
+func (asmf *ASMapFormatter) loadState(data json.RawMessage) error {
+	var state map[uint32]savedASNode
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for as, sn := range state {
+		next := sn.Next
+		if next == nil {
+			next = []uint32{}
+		}
+		asmf.asMap.nodes[as] = &ASNode{as: as, ct: sn.Count, next: next, isOrigin: sn.Origin}
+	}
+	return nil
+}
+
+func (asmf *ASMapFormatter) formatsInParallel() {}
@@ -1,109 +1,449 @@
 package gobgpdump
 
 import (
+	"context"
 	"fmt"
-	pp "github.com/CSUNetSec/protoparse"
 	filter "github.com/CSUNetSec/protoparse/filter"
 	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Simple worker function, launched in a new goroutine.
-// Reads from stringsource and launches dumpfile
-func DumpWorker(dc *DumpConfig, wg *sync.WaitGroup) {
+// Reads from stringsource and launches dumpfile until the
+// source is empty or ctx is cancelled
+func DumpWorker(ctx context.Context, dc *DumpConfig, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	// dc.source must be thread safe
 	name, serr := dc.source.Next()
 
-	for serr == nil {
-		dumpFile(name, dc)
+	for serr == nil && ctx.Err() == nil {
+		// Files done before a resumed dump are skipped, and no file is
+		// started while a checkpoint is due
+		if !dc.cp.startFile(name) {
+			if ctx.Err() == nil {
+				dc.prog.skipFile(name)
+			}
+			name, serr = dc.source.Next()
+			continue
+		}
+		err := dumpFile(ctx, name, dc, dc.writeMsg)
+		// On an unsuccessful dump with the abort policy, other
+		// workers should also stop
+		if err != nil && dc.onError == OnErrorAbort && ctx.Err() == nil {
+			dc.log.WriteString(fmt.Sprintf("Aborting dump: %s\n", err))
+			dc.abort()
+			dc.cp.endFile(ctx, name)
+			return
+		}
+		dc.cp.endFile(ctx, name)
+		dc.prog.endFile(ctx)
 		name, serr = dc.source.Next()
 	}
-	// On an unsuccessful dump, other threads should also stop
-	// TODO: add context to DumpConfig
-	if serr != EOP {
+
+	if serr != nil && serr != EOP {
 		fmt.Printf("Dump unsucessful: %s\n", serr)
 	}
 }
 
+// If this is passed as an input file name, MRT data is read
+// from stdin instead of a file
+const StdinName = "-"
+
 // Main compenent of the program. Opens a file, parses messages,
-// filters them, formats them, and writes them to the dump file
-func dumpFile(name string, dc *DumpConfig) {
-	// At this point, we only want to read bzipped files
-	if !isBz2(name) && false {
-		dc.log.WriteString(fmt.Sprintf("Couldn't open: %s: not a bz2 file\n", name))
-		return
+// filters them, and hands every message that passes to emit.
+// Returns an error if the file could not be read to the end.
+func dumpFile(ctx context.Context, name string, dc *DumpConfig, emit msgSink) error {
+	if name == StdinName {
+		return dumpReader(ctx, os.Stdin, "<stdin>", dc, emit)
 	}
 
 	mrtFile, err := os.Open(name)
 	if err != nil {
 		dc.log.WriteString("Error opening file: " + name + "\n")
-		return
+		return err
 	}
 	defer mrtFile.Close()
 
-	scanner := getScanner(mrtFile)
+	return dumpReader(ctx, mrtFile, name, dc, emit)
+}
+
+// Receives the messages that pass the filters
+type msgSink func(mbs *mrt.MrtBufferStack, info MBSInfo)
+
+// Formats a message and writes it to the dump file
+func (dc *DumpConfig) writeMsg(mbs *mrt.MrtBufferStack, info MBSInfo) {
+	output, err := dc.fmtr.format(mbs, info)
+	if err != nil {
+		dc.log.WriteString(fmt.Sprintf("%s\n", err))
+	} else {
+		dc.dump.WriteString(output)
+	}
+}
+
+// DumpReader runs the MRT data in r through the same scanner,
+// filters and formatter as an input file. The name is used in the
+// log and stat output. Compressed data is detected and decompressed.
+// Errors are handled according to the error policy of dc, and
+// the error that stopped the dump is returned.
+func DumpReader(ctx context.Context, r io.Reader, name string, dc *DumpConfig) error {
+	return dumpReader(ctx, r, name, dc, dc.writeMsg)
+}
+
+// Reads like DumpReader, but hands the messages that pass to emit.
+// The records are parsed by a pool of parse workers, separate from
+// the workers reading files, and the messages are handed on in the
+// order of the file
+func dumpReader(ctx context.Context, r io.Reader, name string, dc *DumpConfig, emit msgSink) error {
+	dr, codec, err := getDecompressor(dc.prog.reader(r))
+	if err != nil {
+		dc.log.WriteString(fmt.Sprintf("Error reading %s: %s\n", name, err))
+		return err
+	}
+	dc.log.WriteString(fmt.Sprintf("Reading %s, compression: %s\n", name, codec))
+
+	start := time.Now()
+	workers := dc.parsers
+	// Messages are formatted by the parse workers if the formatter
+	// allows it, and if they aren't passed on to the ordered merge
+	_, parallel := dc.fmtr.(parallelFormatter)
+	fp := &fileParse{
+		name:      name,
+		collector: dc.collector(name),
+		dc:        dc,
+		formatted: parallel && !dc.ordered,
+		jobs:      make(chan recordJob, workers),
+		results:   make(chan *recordResult, workers),
+		slots:     make(chan struct{}, workers*recordsPerWorker),
+	}
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		// The reader may outlive dumpReader, so it closes dr itself
+		defer dr.Close()
+		fp.read(pctx, dr)
+	}()
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go fp.work(pctx, wg)
+	}
+	go func() {
+		wg.Wait()
+		close(fp.results)
+	}()
+
 	entryCt := 0
 	passedCt := 0
+	skippedCt := 0
 	sz := 0
-	start := time.Now()
 
-	isRib := false
-	var index pp.PbVal
-	var mbs *mrt.MrtBufferStack
+	// Bad records are skipped in resync mode, or if the error policy
+	// says so. Otherwise the rest of the file is abandoned
+	skipBad := dc.resync || dc.onError == OnErrorSkipMsg
 
-	for scanner.Scan() {
-		entryCt++
-		data := scanner.Bytes()
-		sz += len(data)
+	// While the timestamps in the file are in order, reading can
+	// stop at the first message well past the end of the time window
+	inOrder := true
+	var lastTime time.Time
 
-		r, err := mrt.IsRib(data)
-		if err != nil {
-			dc.log.WriteString(fmt.Sprintf("[%d] Error: %s\n", entryCt, err))
-			break
-		}
+	// Records of types that can't be parsed are skipped, and logged
+	// once for each type
+	unsupported := make(map[mrtRecordType]bool)
 
-		if r {
-			if isRib {
-				mbs, err = mrt.ParseRibHeaders(data, index)
-			} else {
-				mbs, err = mrt.ParseHeaders(data, true)
-				index = mbs.Ribbuf
-				isRib = true
-				// The index message should not pass through any filtering or formatting
-				continue
+	// Handles a record in the order of the file. Returns false to
+	// stop reading, with the error that stopped it if there is one
+	handle := func(res *recordResult) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			dc.log.WriteString(fmt.Sprintf("Stopped reading %s after %d entries: %s\n", name, entryCt, err))
+			return false, err
+		}
+		entryCt = res.seq
+		sz += res.size
+		dc.prog.addRecord(res.err == nil && len(res.msgs) > 0)
+		if res.err != nil {
+			skippedCt++
+			dc.log.WriteString(fmt.Sprintf("[%d] Error at offset %d of %s: %s\n", res.seq, res.offset, name, res.err))
+			return skipBad, res.err
+		}
+		if res.unsupported {
+			skippedCt++
+			if !unsupported[res.recType] {
+				unsupported[res.recType] = true
+				dc.log.WriteString(fmt.Sprintf("[%d] Skipping records of unsupported MRT type %d, subtype %d in %s\n", res.seq, res.recType.mrtType, res.recType.subtype, name))
 			}
-		} else {
-			mbs, err = mrt.ParseHeaders(data, false)
+			return true, nil
+		}
+		// Index tables don't pass through any filtering or formatting
+		if res.index {
+			return true, nil
 		}
 
-		if err != nil {
-			dc.log.WriteString(fmt.Sprintf("[%d] Error: %s\n", entryCt, err))
-			break
+		if dc.window != nil {
+			if res.ts.Before(lastTime) {
+				inOrder = false
+			}
+			lastTime = res.ts
+			if inOrder && dc.window.isWellPast(res.ts) {
+				dc.log.WriteString(fmt.Sprintf("Stopped reading %s at entry %d: past the end of the time window\n", name, entryCt))
+				return false, nil
+			}
 		}
 
-		if filter.FilterAll(dc.filters, mbs) {
-			passedCt++
-			output, err := dc.fmtr.format(mbs, NewMBSInfo(name, entryCt))
-			if err != nil {
-				dc.log.WriteString(fmt.Sprintf("%s\n", err))
+		for _, msg := range res.msgs {
+			if !fp.formatted {
+				emit(msg.mbs, res.info)
+			} else if msg.err != nil {
+				dc.log.WriteString(fmt.Sprintf("%s\n", msg.err))
 			} else {
-				dc.dump.WriteString(output)
+				dc.dump.WriteString(msg.output)
 			}
 		}
+		if len(res.msgs) > 0 {
+			passedCt++
+		}
+		return true, nil
+	}
 
+	// Results come in whatever order the workers finish them, and
+	// are held here until the records before them are handled
+	pending := make(map[int]*recordResult)
+	next := 1
+	var stopErr error
+	stopped := false
+	for res := range fp.results {
+		pending[res.seq] = res
+		for !stopped {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-fp.slots
+			if goOn, err := handle(res); !goOn {
+				stopped, stopErr = true, err
+			}
+		}
+		if stopped {
+			break
+		}
+	}
+	cancel()
+	wg.Wait()
+	// After an early stop, the reader may be blocked in a Read that
+	// won't return for a while, like on an idle pipe, so it isn't
+	// waited for. It exits once the Read returns
+	if !stopped && ctx.Err() == nil {
+		<-readDone
 	}
 
-	if err = scanner.Err(); err != nil {
-		dc.log.WriteString("Scanner returned an error.\n")
-		return
+	skippedCt += int(atomic.LoadInt64(&fp.resyncSkips))
+	if !stopped {
+		if err := ctx.Err(); err != nil {
+			dc.log.WriteString(fmt.Sprintf("Stopped reading %s after %d entries: %s\n", name, entryCt, err))
+			return err
+		}
+		if fp.scanErr != nil {
+			dc.log.WriteString(fmt.Sprintf("Scanner returned an error: %s\n", fp.scanErr))
+			stopErr = fp.scanErr
+		}
+	} else if stopErr != nil && ctx.Err() != nil {
+		// Stopped by ctx, which handle has logged
+		return stopErr
+	}
+	// A file stopped by an error still has its stats, unless the
+	// error aborts the whole dump
+	if stopErr != nil && dc.onError == OnErrorAbort {
+		return stopErr
 	}
 
 	dt := time.Since(start)
-	statstr := fmt.Sprintf("Scanned %s: %d entries, %d passed filters, total size: %d bytes in %v\n", name, entryCt, passedCt, sz, dt)
-	dc.stat.WriteString(statstr)
+	statstr := fmt.Sprintf("Scanned %s: %d entries, %d passed filters, %d skipped, total size: %d bytes in %v", name, entryCt, passedCt, skippedCt, sz, dt)
+	if stopErr != nil {
+		statstr += fmt.Sprintf(", stopped at entry %d by an error", entryCt)
+	}
+	dc.stat.WriteString(statstr + "\n")
+	return stopErr
+}
+
+// The number of records each parse worker may get ahead of the
+// first record that isn't handled yet
+const recordsPerWorker = 64
+
+// The reader and parse workers of an input. The reader frames
+// records and numbers them in the order of the file. The workers
+// parse, filter and possibly format them, and dumpReader handles
+// the results in the order of their sequence numbers
+type fileParse struct {
+	name      string
+	collector string
+	dc        *DumpConfig
+	formatted bool // whether the workers format messages
+
+	jobs    chan recordJob
+	results chan *recordResult
+	// A slot is taken for every record read, and given back once it
+	// is handled, so the results held for reordering are bounded
+	slots chan struct{}
+
+	// Counted by the reader, which may still be running when the
+	// count is read
+	resyncSkips int64
+	// Set by the reader, and only read once it is done
+	scanErr error
+}
+
+// A record for the parse workers. Records are numbered from 1
+type recordJob struct {
+	seq    int
+	offset int64 // in the decompressed data
+	data   []byte
+	parser recordParser // with the index table the record refers to
+	index  bool         // the record is an index table the reader parsed
+	err    error        // the error from parsing an index table
+}
+
+// What a parse worker made of a record
+type recordResult struct {
+	seq    int
+	offset int64
+	size   int
+	err    error
+	index  bool
+	ts     time.Time
+	info   MBSInfo
+	msgs   []parsedMsg // the messages that passed the filters
+
+	unsupported bool // the record is of a type that isn't parsed
+	recType     mrtRecordType
+}
+
+// A message that passed the filters, with its output if the worker
+// formatted it
+type parsedMsg struct {
+	mbs    *mrt.MrtBufferStack
+	output string
+	err    error
+}
+
+// The reader stage. Index tables change how the records after them
+// are parsed, so the reader parses those itself, and every record
+// carries a copy of the parser as it is when the record is read
+func (fp *fileParse) read(ctx context.Context, r io.Reader) {
+	defer close(fp.jobs)
+	dc := fp.dc
+	scanner := getScanner(r)
+	splitter := newMrtSplitter(dc.resync)
+	scanner.Split(splitter.split)
+	parser := &recordParser{}
+
+	for seq := 1; scanner.Scan(); seq++ {
+		for _, sk := range splitter.takeSkipped() {
+			atomic.AddInt64(&fp.resyncSkips, 1)
+			dc.log.WriteString(fmt.Sprintf("Skipped %d corrupt bytes at offset %d of %s\n", sk.length, sk.offset, fp.name))
+		}
+		// The scanner reuses its buffer for the next record
+		data := append([]byte(nil), scanner.Bytes()...)
+
+		job := recordJob{seq: seq, offset: splitter.start, data: data}
+		if isPeerIndexTable(data) {
+			job.index = true
+			_, job.err = parser.parse(data)
+		}
+		job.parser = *parser
+
+		select {
+		case fp.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case fp.jobs <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+	for _, sk := range splitter.takeSkipped() {
+		atomic.AddInt64(&fp.resyncSkips, 1)
+		dc.log.WriteString(fmt.Sprintf("Skipped %d corrupt bytes at offset %d of %s\n", sk.length, sk.offset, fp.name))
+	}
+	fp.scanErr = scanner.Err()
+}
+
+// A parse worker
+func (fp *fileParse) work(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		var job recordJob
+		var ok bool
+		select {
+		case job, ok = <-fp.jobs:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		res := fp.parseRecord(job)
+		select {
+		case fp.results <- res:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
+// Parses a record, and filters each of its messages
+func (fp *fileParse) parseRecord(job recordJob) *recordResult {
+	dc := fp.dc
+	res := &recordResult{seq: job.seq, offset: job.offset, size: len(job.data), index: job.index, err: job.err}
+	if job.index {
+		return res
+	}
+	mbs, err := job.parser.parse(job.data)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if mbs == nil {
+		res.unsupported = true
+		res.recType = getRecordType(job.data)
+		return res
+	}
+	res.ts = getTimestamp(mbs)
+	res.info = NewMBSInfo(fp.name, job.seq)
+	res.info.collector = fp.collector
+
+	// Each entry of a RIB message is a message of its own from
+	// here on. Messages of other classes, and prefixes of other
+	// address families or dropped bogons, are removed before any
+	// filter or formatter sees the message
+	for _, msg := range splitRib(mbs) {
+		if !keepMsgClasses(msg, dc.classes) {
+			continue
+		}
+		if dc.afi != afiAny && !keepAFI(msg, dc.afi) {
+			continue
+		}
+		if dc.drop && !dc.bogons.dropBogons(msg) {
+			continue
+		}
+		if !filter.FilterAll(dc.filters, msg) {
+			continue
+		}
+		pm := parsedMsg{mbs: msg}
+		if fp.formatted {
+			pm.output, pm.err = dc.fmtr.format(msg, res.info)
+		}
+		res.msgs = append(res.msgs, pm)
+	}
+	return res
 }
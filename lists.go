@@ -0,0 +1,132 @@
+// Prefix and AS lists read from files. A list file has one entry per
+// line, and anything after a # is a comment. Files can also hold RPSL
+// objects, like an IRR database exported to disk. From those, the
+// route and route6 attributes are read as prefixes, and the origin
+// and aut-num attributes as AS numbers. Every other attribute is
+// ignored.
+
+package gobgpdump
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An RPSL attribute starts a line with its name followed by a colon.
+// Requiring a space or the end of the line after the colon keeps
+// IPv6 prefixes like fe80::/10 from looking like attributes.
+var rpslAttr = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_-]*):(\s|$)`)
+
+// Reads a list file, calling add with each entry and the line it was
+// on. For RPSL attributes, the entry is the value of the attribute and
+// attr is its name in lower case. attr is empty for plain entries.
+func readListFile(name string, add func(entry, attr string) error) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return readList(fd, name, add)
+}
+
+// Like readListFile, but reads the list from r. The name is only
+// used in errors
+func readList(r io.Reader, name string, add func(entry, attr string) error) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	inObject := false
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		// Continuation lines of an RPSL attribute start with
+		// whitespace or a +. They are never list entries
+		if inObject && len(line) > 0 && strings.ContainsRune(" \t+", rune(line[0])) {
+			continue
+		}
+		// A blank line ends an RPSL object
+		if scanner.Text() == "" {
+			inObject = false
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		attr := ""
+		if m := rpslAttr.FindStringSubmatch(line); m != nil {
+			inObject = true
+			attr = strings.ToLower(m[1])
+			line = strings.TrimSpace(line[len(m[1])+1:])
+			if line == "" {
+				continue
+			}
+		}
+		if err := add(line, attr); err != nil {
+			return fmt.Errorf("%s:%d: %s", name, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the prefix list entries in a file. Plain entries may carry
+// a mode or a length range, like on the command line.
+func readPrefixFile(name string) ([]string, error) {
+	var entries []string
+	err := readListFile(name, func(entry, attr string) error {
+		switch attr {
+		case "":
+		case "route", "route6":
+			entry = strings.Fields(entry)[0]
+		default:
+			return nil
+		}
+		if _, _, err := net.ParseCIDR(strings.Fields(entry)[0]); err != nil {
+			return fmt.Errorf("Malformed prefix: %s", entry)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// Returns the AS numbers in a file. They may be written as 3356
+// or AS3356
+func readASFile(name string) ([]uint32, error) {
+	var ases []uint32
+	err := readListFile(name, func(entry, attr string) error {
+		switch attr {
+		case "", "origin", "aut-num":
+		default:
+			return nil
+		}
+		as, err := parseASNumber(strings.Fields(entry)[0])
+		if err != nil {
+			return err
+		}
+		ases = append(ases, as)
+		return nil
+	})
+	return ases, err
+}
+
+func parseASNumber(str string) (uint32, error) {
+	num := str
+	if len(num) > 2 && strings.EqualFold(num[:2], "AS") {
+		num = num[2:]
+	}
+	as, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed AS number: %s", str)
+	}
+	return uint32(as), nil
+}
@@ -0,0 +1,203 @@
+// The ordered mode, which writes the messages of every input file as
+// one stream in time order. Each file is read by a worker of its own,
+// which parses and filters messages into a bounded buffer, and the
+// messages are merged from the buffers by their MRT timestamp and
+// formatted in that order.
+//
+// A file is only opened once it could have the next message, so the
+// files are first sorted by the time of their first record. Beyond
+// that, up to the worker count of files are read ahead. Records within
+// a file are taken in their order in the file.
+
+package gobgpdump
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+// The number of messages a worker can get ahead of the merge
+const orderedBufferLen = 1024
+
+// A message that passed the filters, waiting to be formatted
+type orderedMsg struct {
+	mbs  *mrt.MrtBufferStack
+	info MBSInfo
+	ts   time.Time
+}
+
+// An input file of the ordered mode, and the buffer of its worker
+type orderedFile struct {
+	name  string
+	pos   int             // the position of the file in time order
+	start time.Time       // the time of its first record
+	msgs  chan orderedMsg // made once the file is started
+	head  orderedMsg      // the next message of the file
+}
+
+// Files in the merge, by the time of their next message. Files with
+// messages at the same time keep their order
+type fileHeap []*orderedFile
+
+func (h fileHeap) Len() int { return len(h) }
+
+func (h fileHeap) Less(i, j int) bool {
+	if h[i].head.ts.Equal(h[j].head.ts) {
+		return h[i].pos < h[j].pos
+	}
+	return h[i].head.ts.Before(h[j].head.ts)
+}
+
+func (h fileHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *fileHeap) Push(x interface{}) { *h = append(*h, x.(*orderedFile)) }
+
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// Reads every input file of dc, and writes the messages that pass the
+// filters in time order. Returns once every file is read or ctx is
+// cancelled
+func DumpOrdered(ctx context.Context, dc *DumpConfig) {
+	files, err := getOrderedFiles(dc)
+	if err != nil {
+		fmt.Printf("Dump unsucessful: %s\n", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	merge := &fileHeap{}
+	next := 0
+	// Starts the worker of the next file, and waits for its first
+	// message. Files without any are done
+	startFile := func() {
+		f := files[next]
+		next++
+		f.msgs = make(chan orderedMsg, orderedBufferLen)
+		wg.Add(1)
+		go orderedWorker(ctx, f, dc, wg)
+		if m, ok := <-f.msgs; ok {
+			f.head = m
+			heap.Push(merge, f)
+		}
+	}
+
+	for ctx.Err() == nil {
+		// Every file starting before the next message must be in
+		// the merge. Other files are started to keep the workers busy
+		for next < len(files) && (merge.Len() == 0 || merge.Len() < dc.workers ||
+			!files[next].start.After((*merge)[0].head.ts)) {
+			startFile()
+		}
+		if merge.Len() == 0 {
+			return
+		}
+
+		f := (*merge)[0]
+		dc.writeMsg(f.head.mbs, f.head.info)
+		if m, ok := <-f.msgs; ok {
+			f.head = m
+			heap.Fix(merge, 0)
+		} else {
+			heap.Pop(merge)
+		}
+	}
+}
+
+// Reads a file into its buffer, which is closed at the end. Errors are
+// handled like they are by DumpWorker
+func orderedWorker(ctx context.Context, f *orderedFile, dc *DumpConfig, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(f.msgs)
+
+	err := dumpFile(ctx, f.name, dc, func(mbs *mrt.MrtBufferStack, info MBSInfo) {
+		select {
+		case f.msgs <- orderedMsg{mbs, info, getTimestamp(mbs)}:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil && dc.onError == OnErrorAbort && ctx.Err() == nil {
+		dc.log.WriteString(fmt.Sprintf("Aborting dump: %s\n", err))
+		dc.abort()
+	}
+	dc.prog.endFile(ctx)
+}
+
+// Takes every file from the source of dc, and sorts them by the time
+// of their first record. The first records are read by as many
+// goroutines as there are workers. Returns the files read from the
+// source before any error
+func getOrderedFiles(dc *DumpConfig) ([]*orderedFile, error) {
+	var files []*orderedFile
+	name, err := dc.source.Next()
+	for ; err == nil; name, err = dc.source.Next() {
+		files = append(files, &orderedFile{name: name})
+	}
+	if err == EOP {
+		err = nil
+	}
+
+	todo := make(chan *orderedFile)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < dc.workers || w == 0; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range todo {
+				f.start = firstTimestamp(f.name)
+			}
+		}()
+	}
+	for _, f := range files {
+		todo <- f
+	}
+	close(todo)
+	wg.Wait()
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].start.Before(files[j].start)
+	})
+	for i, f := range files {
+		f.pos = i
+	}
+	return files, err
+}
+
+// Returns the time of the first record of a file. If the file can't be
+// read, or is stdin, which can only be read once, the zero time is
+// returned, so the file is read first and its worker reports the error
+func firstTimestamp(name string) time.Time {
+	if name == StdinName {
+		return time.Time{}
+	}
+	fd, err := os.Open(name)
+	if err != nil {
+		return time.Time{}
+	}
+	defer fd.Close()
+	dr, _, err := getDecompressor(fd)
+	if err != nil {
+		return time.Time{}
+	}
+	defer dr.Close()
+
+	hdr := make([]byte, mrt.MRT_HEADER_LEN)
+	if _, err := io.ReadFull(dr, hdr); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(hdr[0:4])), 0)
+}
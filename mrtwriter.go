@@ -0,0 +1,257 @@
+// The MRT writer, which writes the messages that pass the filters as
+// MRT records, so a filtered subset of a file is a valid MRT file.
+// A RIB entry needs the PEER_INDEX_TABLE it refers to, which is
+// written before it whenever it isn't the last one written. With
+// reindexing, every entry refers instead to a single index table of
+// only the peers that are written. That table is complete only once
+// every file is read, so until then the records are held in a
+// temporary file.
+//
+// At a checkpoint, compressed output is finished and started again on
+// the same file, so the output holds a whole number of compressed
+// streams, which the decompressors read as one. Reindexed output
+// can't be checkpointed.
+
+package gobgpdump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+type MRTFormatter struct {
+	fd          io.Writer // the dump output
+	compression string
+	output      io.WriteCloser // the compressed dump output
+	w           *bufio.Writer  // where records are written, output or spool
+	mux         *sync.Mutex
+	lastIndex   []byte // the last index table written, without reindexing
+
+	// These are only used with reindexing
+	reindex   bool
+	spool     *os.File
+	indexHead []byte             // MRT header, collector BGP ID and view name of the index table
+	peers     [][]byte           // the raw peer entries of the index table
+	peerNums  map[string]uint16  // the position of each raw peer entry in peers
+	srcPeers  map[*byte][][]byte // the raw peer entries of each input index table
+}
+
+// Returns an MRT writer to fd, which compresses its output with
+// the named codec
+func NewMRTFormatter(fd io.Writer, compression string, reindex bool) (*MRTFormatter, error) {
+	output, err := getCompressor(fd, compression)
+	if err != nil {
+		return nil, err
+	}
+	m := &MRTFormatter{fd: fd, compression: compression, output: output, mux: &sync.Mutex{}, reindex: reindex}
+	if !reindex {
+		m.w = bufio.NewWriter(output)
+		return m, nil
+	}
+
+	if m.spool, err = ioutil.TempFile("", "gobgpdump-mrt"); err != nil {
+		output.Close()
+		return nil, err
+	}
+	m.w = bufio.NewWriter(m.spool)
+	m.peerNums = make(map[string]uint16)
+	m.srcPeers = make(map[*byte][][]byte)
+	return m, nil
+}
+
+// Records are written directly, so nothing is returned
+func (m *MRTFormatter) format(mbs *mrt.MrtBufferStack, _ MBSInfo) (string, error) {
+	rec := rawRecord(mbs)
+	if len(rec) == 0 {
+		return "", nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	// BGP4MP and legacy TABLE_DUMP records don't need an index table
+	ir, ok := mbs.Ribbuf.(*indexedRib)
+	if !ok || ir.index == nil {
+		_, err := m.w.Write(rec)
+		return "", err
+	}
+
+	if m.reindex {
+		rec, err := m.renumberPeers(rec, ir.index)
+		if err != nil {
+			return "", err
+		}
+		_, err = m.w.Write(rec)
+		return "", err
+	}
+
+	// Every input file has index tables of its own, so this only
+	// compares which table it is, not the peers in it
+	if len(m.lastIndex) == 0 || &m.lastIndex[0] != &ir.index[0] {
+		if _, err := m.w.Write(ir.index); err != nil {
+			return "", err
+		}
+		m.lastIndex = ir.index
+	}
+	_, err := m.w.Write(rec)
+	return "", err
+}
+
+// Returns a copy of a RIB record with the peer index of every entry
+// changed to that of the same peer in the output index table. Peers
+// the table doesn't have yet are added to it
+func (m *MRTFormatter) renumberPeers(rec, index []byte) ([]byte, error) {
+	src, ok := m.srcPeers[&index[0]]
+	if !ok {
+		head, peers, err := readPeerIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		// The collector and view of the first table are kept
+		if m.indexHead == nil {
+			m.indexHead = head
+		}
+		m.srcPeers[&index[0]] = peers
+		src = peers
+	}
+
+	rec = append([]byte(nil), rec...)
+	_, entries := ribEntries(rec[mrt.MRT_HEADER_LEN:], binary.BigEndian.Uint16(rec[6:8]))
+	for _, ent := range entries {
+		old := binary.BigEndian.Uint16(ent[0:2])
+		if int(old) >= len(src) {
+			return nil, fmt.Errorf("RIB entry refers to peer %d of a PEER_INDEX_TABLE with %d peers", old, len(src))
+		}
+		num, ok := m.peerNums[string(src[old])]
+		if !ok {
+			if len(m.peers) > 0xffff {
+				return nil, fmt.Errorf("Too many peers for one PEER_INDEX_TABLE")
+			}
+			num = uint16(len(m.peers))
+			m.peerNums[string(src[old])] = num
+			m.peers = append(m.peers, src[old])
+		}
+		binary.BigEndian.PutUint16(ent[0:2], num)
+	}
+	return rec, nil
+}
+
+// Splits a raw PEER_INDEX_TABLE record into its head, the MRT header,
+// collector BGP ID and view name, and its raw peer entries
+func readPeerIndex(rec []byte) (head []byte, peers [][]byte, err error) {
+	body, ok := mrtBody(rec)
+	if !ok || len(body) < 6 {
+		return nil, nil, fmt.Errorf("Malformed PEER_INDEX_TABLE")
+	}
+	vlen := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 8+vlen {
+		return nil, nil, fmt.Errorf("Malformed PEER_INDEX_TABLE")
+	}
+	head = rec[:mrt.MRT_HEADER_LEN+6+vlen]
+	count := int(binary.BigEndian.Uint16(body[6+vlen : 8+vlen]))
+	body = body[8+vlen:]
+
+	for i := 0; i < count; i++ {
+		if len(body) < 1 {
+			return nil, nil, fmt.Errorf("Malformed PEER_INDEX_TABLE")
+		}
+		// Peer type, BGP ID, IP and AS. The low bits of the type
+		// are set for an IPv6 address and a 4 byte AS
+		plen := 1 + 4 + 4 + 2
+		if body[0]&0x1 != 0 {
+			plen += 12
+		}
+		if body[0]&0x2 != 0 {
+			plen += 2
+		}
+		if len(body) < plen {
+			return nil, nil, fmt.Errorf("Malformed PEER_INDEX_TABLE")
+		}
+		peers = append(peers, body[:plen])
+		body = body[plen:]
+	}
+	return head, peers, nil
+}
+
+// Builds the output index table from the peers of the records
+// written to the spool
+func (m *MRTFormatter) indexRecord() []byte {
+	rec := append([]byte(nil), m.indexHead...)
+	rec = append(rec, byte(len(m.peers)>>8), byte(len(m.peers)))
+	for _, peer := range m.peers {
+		rec = append(rec, peer...)
+	}
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(rec)-mrt.MRT_HEADER_LEN))
+	return rec
+}
+
+// With reindexing, the index table and the spooled records are
+// written here. The compressed output is finished either way
+func (m *MRTFormatter) summarize() {
+	err := m.w.Flush()
+	if m.reindex {
+		err = m.writeSpool(err)
+	}
+	if cerr := m.output.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// The dump output may be stdout, so errors go to stderr
+		fmt.Fprintf(os.Stderr, "Error writing MRT output: %s\n", err)
+	}
+}
+
+// Writes out everything buffered, and finishes the compressed output.
+// The MRT writer has no state to save otherwise
+func (m *MRTFormatter) saveState() (interface{}, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if err := m.w.Flush(); err != nil {
+		return nil, err
+	}
+	if m.compression == "" || m.compression == noCodec {
+		return nil, nil
+	}
+	if err := m.output.Close(); err != nil {
+		return nil, err
+	}
+	output, err := getCompressor(m.fd, m.compression)
+	if err != nil {
+		return nil, err
+	}
+	m.output = output
+	m.w.Reset(output)
+	return nil, nil
+}
+
+func (m *MRTFormatter) loadState(json.RawMessage) error {
+	return nil
+}
+
+// Copies the spool after the index table, and removes it. An error
+// from before is returned in place of any new one
+func (m *MRTFormatter) writeSpool(err error) error {
+	defer os.Remove(m.spool.Name())
+	defer m.spool.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(m.peers) > 0 {
+		if _, err := m.output.Write(m.indexRecord()); err != nil {
+			return err
+		}
+	}
+	if _, err := m.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(m.output, m.spool)
+	return err
+}
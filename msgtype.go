@@ -0,0 +1,187 @@
+// Message classes, which select the kinds of records that reach the
+// filters and the formatter. A BGP4MP record is a state change, or
+// holds an OPEN, UPDATE, NOTIFICATION or KEEPALIVE message. An update
+// can be both an announcement and a withdrawal, in which case the
+// half that isn't selected is removed from it.
+
+package gobgpdump
+
+import (
+	"encoding/json"
+	"fmt"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"strings"
+)
+
+type MsgClass uint
+
+const (
+	MsgAnnounce     = MsgClass(1 << iota) // updates with advertised routes
+	MsgWithdraw                           // updates with withdrawn routes
+	MsgEndOfRIB                           // updates without any prefix, like End-of-RIB markers
+	MsgState                              // BGP4MP_STATE_CHANGE records
+	MsgOpen                               // OPEN messages
+	MsgNotification                       // NOTIFICATION messages
+	MsgKeepalive                          // KEEPALIVE messages
+	MsgOther                              // other BGP messages, like ROUTE-REFRESH
+	MsgRIB                                // TABLE_DUMP_V2 RIB entries
+
+	msgUpdates = MsgAnnounce | MsgWithdraw | MsgEndOfRIB
+	msgAll     = msgUpdates | MsgState | MsgOpen | MsgNotification | MsgKeepalive | MsgOther | MsgRIB
+)
+
+// The classes passed when none are given. Other records used to
+// fail to parse, so they are left out unless asked for.
+const DefaultMsgClasses = msgUpdates | MsgRIB
+
+var msgClassNames = map[string]MsgClass{
+	"announce":     MsgAnnounce,
+	"withdraw":     MsgWithdraw,
+	"eor":          MsgEndOfRIB,
+	"update":       msgUpdates,
+	"state":        MsgState,
+	"open":         MsgOpen,
+	"notification": MsgNotification,
+	"keepalive":    MsgKeepalive,
+	"other":        MsgOther,
+	"rib":          MsgRIB,
+	"all":          msgAll,
+}
+
+// Parses a comma separated list of class names, like
+// "announce,state". An empty list is DefaultMsgClasses
+func parseMsgClasses(list string) (MsgClass, error) {
+	if list == "" {
+		return DefaultMsgClasses, nil
+	}
+	var classes MsgClass
+	for _, name := range strings.Split(list, ",") {
+		class, ok := msgClassNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("Unknown message type: %s", name)
+		}
+		classes |= class
+	}
+	return classes, nil
+}
+
+// Returns the name of a single class, like "open"
+func msgClassName(class MsgClass) string {
+	for name, c := range msgClassNames {
+		if c == class {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the classes of a message. Only updates can have more
+// than one
+func getMsgClass(mbs *mrt.MrtBufferStack) MsgClass {
+	if mbs.IsRibStack() {
+		return MsgRIB
+	}
+	if getStateChange(mbs) != nil {
+		return MsgState
+	}
+	switch bgpMsgType(mbs) {
+	case bgpUpdate:
+	case bgpOpen:
+		return MsgOpen
+	case bgpNotification:
+		return MsgNotification
+	case bgpKeepalive:
+		return MsgKeepalive
+	default:
+		return MsgOther
+	}
+
+	var class MsgClass
+	if len(getMsgPrefixes(mbs, filter.AdvPrefix)) > 0 {
+		class |= MsgAnnounce
+	}
+	if len(getMsgPrefixes(mbs, filter.WdrPrefix)) > 0 {
+		class |= MsgWithdraw
+	}
+	if class == 0 {
+		return MsgEndOfRIB
+	}
+	return class
+}
+
+// Returns the type of the BGP message in a BGP4MP record, or 0 if
+// it has none
+func bgpMsgType(mbs *mrt.MrtBufferStack) int {
+	msg := bgp4mpMessage(mbs.GetRawMessage())
+	if len(msg) < 19 {
+		return 0
+	}
+	return int(msg[18])
+}
+
+// Returns false if a message is in none of the classes. If an update
+// is both an announcement and a withdrawal, but only one of them is
+// selected, the other part is removed from it.
+func keepMsgClasses(mbs *mrt.MrtBufferStack, classes MsgClass) bool {
+	class := getMsgClass(mbs)
+	if class&classes == 0 {
+		return false
+	}
+	if class == MsgAnnounce|MsgWithdraw && class&classes != class {
+		update := mbs.Bgpupbuf.(pp.BGPUpdater).GetUpdate()
+		if classes&MsgAnnounce == 0 {
+			update.AdvertisedRoutes = nil
+		} else {
+			update.WithdrawnRoutes = nil
+		}
+	}
+	return true
+}
+
+// A state of the BGP finite state machine (RFC 4271)
+type bgpState uint16
+
+var bgpStateNames = []string{1: "Idle", "Connect", "Active", "OpenSent", "OpenConfirm", "Established"}
+
+func (s bgpState) String() string {
+	if int(s) < len(bgpStateNames) && bgpStateNames[s] != "" {
+		return bgpStateNames[s]
+	}
+	return fmt.Sprintf("Unknown(%d)", uint16(s))
+}
+
+func (s bgpState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// The old and new state of a peer in a state change
+type stateTransition struct {
+	Old bgpState `json:"old_state"`
+	New bgpState `json:"new_state"`
+}
+
+func (st stateTransition) String() string {
+	return fmt.Sprintf("%s -> %s", st.Old, st.New)
+}
+
+// protoparse doesn't parse BGP4MP_STATE_CHANGE records, so
+// parseBGP4MP wraps their BGP4MP header with the states, much like
+// indexedRib wraps RIB entries
+type stateChange struct {
+	pp.BGP4MPHeaderer
+	states stateTransition
+}
+
+// The header is marshalled as if it weren't wrapped. The JSON
+// formatter adds the states in a field of their own
+func (sc *stateChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sc.BGP4MPHeaderer)
+}
+
+// Returns the state change in a message, or nil if it isn't one
+func getStateChange(mbs *mrt.MrtBufferStack) *stateChange {
+	sc, _ := mbs.Bgp4mpbuf.(*stateChange)
+	return sc
+}
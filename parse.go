@@ -0,0 +1,510 @@
+// Parsing of BGP4MP messages. protoparse decodes every prefix of an
+// update with the address family of the BGP session, so an IPv6
+// MP_REACH_NLRI on an IPv4 session fails to parse, and IPv4 NLRI on an
+// IPv6 session come out as IPv6 prefixes. Here the update is parsed
+// with the family of its MP attributes, and the prefixes are read
+// again from the raw message: the classic withdrawn routes and NLRI
+// are always IPv4, and MP_REACH_NLRI and MP_UNREACH_NLRI have their
+// own AFI. Prefixes from both end up in the same lists, so filters
+// and formatters treat them alike.
+
+package gobgpdump
+
+import (
+	"encoding/binary"
+	"fmt"
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	"github.com/CSUNetSec/protoparse/protocol/bgp"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"net"
+	"strings"
+)
+
+const (
+	attrNextHop   = 3
+	attrMPReach   = 14
+	attrMPUnreach = 15
+)
+
+// BGP4MP subtypes with 2 and 4 byte AS numbers. protoparse has
+// MESSAGE_LOCAL as 7, which is MESSAGE_AS4_LOCAL, and has no state
+// change or ADD-PATH (RFC 8050) subtypes
+const (
+	bgp4mpStateChange2         = 0
+	bgp4mpMessage2             = 1
+	bgp4mpMessage4             = 4
+	bgp4mpStateChange4         = 5
+	bgp4mpMessageLocal2        = 6
+	bgp4mpMessageLocal4        = 7
+	bgp4mpMessageAddPath2      = 8
+	bgp4mpMessageAddPath4      = 9
+	bgp4mpMessageLocalAddPath2 = 10
+	bgp4mpMessageLocalAddPath4 = 11
+)
+
+// BGP message types
+const (
+	bgpOpen         = 1
+	bgpUpdate       = 2
+	bgpNotification = 3
+	bgpKeepalive    = 4
+)
+
+// Address family identifiers, which are also the values of -afi
+const (
+	afiAny  = 0
+	afiIPv4 = 1
+	afiIPv6 = 2
+)
+
+func parseAFI(str string) (int, error) {
+	switch strings.ToLower(str) {
+	case "":
+		return afiAny, nil
+	case "ipv4", "4":
+		return afiIPv4, nil
+	case "ipv6", "6":
+		return afiIPv6, nil
+	}
+	return 0, fmt.Errorf("Unknown address family: %s", str)
+}
+
+// Parses the records of one input by their MRT type and subtype, so
+// a file may mix RIB and BGP4MP records. RIB entries refer to the
+// last PEER_INDEX_TABLE before them, which a file may have several of.
+// The raw record of the index table is kept as well.
+type recordParser struct {
+	index    pp.PbVal
+	rawIndex []byte
+}
+
+// Whether a raw record is a TABLE_DUMP_V2 PEER_INDEX_TABLE
+func isPeerIndexTable(data []byte) bool {
+	return len(data) >= mrt.MRT_HEADER_LEN &&
+		binary.BigEndian.Uint16(data[4:6]) == mrt.TABLE_DUMP_V2 &&
+		binary.BigEndian.Uint16(data[6:8]) == mrt.PEER_INDEX_TABLE
+}
+
+// Returns the parsed record, or nil without an error for a
+// PEER_INDEX_TABLE, which is kept for the records that follow, and
+// for a record of a type or subtype that isn't supported, which is
+// skipped. Errors are only returned for malformed records
+func (rp *recordParser) parse(data []byte) (*mrt.MrtBufferStack, error) {
+	if len(data) < mrt.MRT_HEADER_LEN {
+		return nil, fmt.Errorf("Not enough bytes in data slice to decode MRT header")
+	}
+	mrtType := binary.BigEndian.Uint16(data[4:6])
+	subtype := binary.BigEndian.Uint16(data[6:8])
+
+	switch mrtType {
+	case mrt.BGP4MP, mrt.BGP4MP_ET:
+		if _, ok := bgp4mpAS4(subtype); !ok {
+			return nil, nil
+		}
+		return parseBGP4MP(data)
+	case mrt.TABLE_DUMP:
+		return parseTableDump(data)
+	case mrt.TABLE_DUMP_V2:
+		if subtype == mrt.PEER_INDEX_TABLE {
+			mbs, err := mrt.ParseHeaders(data, true)
+			if err != nil {
+				return nil, err
+			}
+			rp.index = mbs.Ribbuf
+			// The scanner reuses data for the next record
+			rp.rawIndex = append([]byte(nil), data...)
+			return nil, nil
+		}
+		ribData := data
+		var ids []uint32
+		switch {
+		case subtype >= ribIPv4Unicast && subtype <= ribIPv6Multicast:
+		case subtype >= ribIPv4UnicastAddPath && subtype <= ribIPv6MulticastAddPath:
+			var ok bool
+			if ribData, ids, ok = stripRibPathIDs(data); !ok {
+				return nil, fmt.Errorf("Failed parsing RIB header: malformed ADD-PATH entries\n")
+			}
+		default:
+			// RIB_GENERIC and GEO_PEER_TABLE among others
+			return nil, nil
+		}
+		if rp.index == nil {
+			return nil, fmt.Errorf("RIB entry without a PEER_INDEX_TABLE before it")
+		}
+		mbs, err := mrt.ParseRibHeaders(ribData, rp.index)
+		if err != nil {
+			return nil, err
+		}
+		if ids != nil {
+			// The header and raw message are those of the record
+			// with its path IDs
+			mrth := mrt.NewRIBMrtHdrBuf(data, rp.index)
+			if _, err := mrth.Parse(); err != nil {
+				return nil, fmt.Errorf("Failed parsing MRT header: %s\n", err)
+			}
+			mbs.MrthBuf = mrth
+		}
+		mbs.Ribbuf = newIndexedRib(mbs.Ribbuf, rp.index, rp.rawIndex, ids)
+		reparseRibAttrs(mbs)
+		return mbs, nil
+	}
+	return nil, nil
+}
+
+// The type and subtype of an MRT record
+type mrtRecordType struct {
+	mrtType, subtype uint16
+}
+
+func getRecordType(data []byte) mrtRecordType {
+	return mrtRecordType{binary.BigEndian.Uint16(data[4:6]), binary.BigEndian.Uint16(data[6:8])}
+}
+
+// Parses a BGP4MP record like mrt.ParseHeaders, but with the
+// prefixes of every address family. State changes and BGP messages
+// other than updates are parsed too, with an empty update, since the
+// mrt helpers expect every BGP4MP stack to have one.
+func parseBGP4MP(data []byte) (*mrt.MrtBufferStack, error) {
+	mrth := mrt.NewMrtHdrBuf(data)
+	// protoparse fills in the MRT header before it looks at the
+	// subtype. It doesn't know every subtype read here, and doesn't
+	// skip the microseconds of BGP4MP_ET, so the BGP4MP header is
+	// parsed from bgp4mpBody instead of the value it returns
+	_, err := mrth.Parse()
+	body, as4, ok := bgp4mpBody(data)
+	if !ok {
+		if err == nil {
+			err = fmt.Errorf("unsupported MRT type or malformed BGP4MP header")
+		}
+		return nil, fmt.Errorf("Failed parsing MRT header: %s\n", err)
+	}
+	bgp4h := mrt.NewBgp4mpHdrBuf(body, as4)
+	bgph, err := bgp4h.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing BG4MP header: %s\n", err)
+	}
+	emptyUpdate := bgp.NewBgpUpdateBuf(nil, false, as4)
+
+	msg := bgp4mpMessage(data)
+	subtype := binary.BigEndian.Uint16(data[6:8])
+	if subtype == bgp4mpStateChange2 || subtype == bgp4mpStateChange4 {
+		if len(msg) < 4 {
+			return nil, fmt.Errorf("Failed parsing BGP4MP state change: not enough bytes\n")
+		}
+		sc := &stateChange{bgp4h, stateTransition{
+			Old: bgpState(binary.BigEndian.Uint16(msg[:2])),
+			New: bgpState(binary.BigEndian.Uint16(msg[2:4])),
+		}}
+		return &mrt.MrtBufferStack{MrthBuf: mrth, Bgp4mpbuf: sc, Bgpupbuf: emptyUpdate}, nil
+	}
+
+	if _, err = bgph.Parse(); err != nil {
+		return nil, fmt.Errorf("Failed parsing BGP header: %s\n", err)
+	}
+	if msg[18] != bgpUpdate {
+		return &mrt.MrtBufferStack{MrthBuf: mrth, Bgp4mpbuf: bgp4h, Bgphbuf: bgph, Bgpupbuf: emptyUpdate}, nil
+	}
+
+	wdr, attrs, nlri, ok := splitUpdate(msg)
+	if !ok {
+		return nil, fmt.Errorf("Failed parsing BGP update: not a complete update message\n")
+	}
+	// Every prefix of an ADD-PATH update has a path ID before it
+	var ids pathIDs
+	addPath := subtype >= bgp4mpMessageAddPath2 && subtype <= bgp4mpMessageLocalAddPath4
+	if addPath {
+		ids = pathIDs{}
+	}
+	mp := parseMPAttrs(attrs, ids)
+
+	// protoparse checks both the NEXT_HOP attribute and the next hop
+	// of MP_REACH_NLRI against the family the update is parsed with.
+	// An update with IPv4 NLRI and IPv6 MP_REACH_NLRI has one of each,
+	// so it is parsed without its MP attributes, which are read above.
+	// protoparse can't read the prefixes of ADD-PATH updates either,
+	// so those are parsed without any prefixes.
+	// Attributes without a value are removed too, and added back
+	// after parsing
+	upBody := msg[19:]
+	mixed := mp.reachAFI == afiIPv6 && len(findRawAttrs(attrs, attrNextHop)) > 0
+	hasMP := mp.reachAFI != 0 || len(findRawAttrs(attrs, attrMPUnreach)) > 0
+	noMP := mixed || (addPath && hasMP)
+	empty := emptyRawAttrs(attrs)
+	if noMP || addPath || len(empty) > 0 {
+		kept := removeRawAttrs(attrs, empty...)
+		if noMP {
+			kept = removeRawAttrs(kept, attrMPReach, attrMPUnreach)
+		}
+		if addPath {
+			upBody = buildUpdate(nil, kept, nil)
+		} else {
+			upBody = buildUpdate(wdr, kept, nlri)
+		}
+	}
+	bgpup := bgp.NewBgpUpdateBuf(upBody, mp.reachAFI == afiIPv6 && !noMP, as4)
+	if _, err = bgpup.Parse(); err != nil {
+		return nil, fmt.Errorf("Failed parsing BGP update: %s\n", err)
+	}
+	update := bgpup.GetUpdate()
+	update.Attrs = addEmptyAttrs(update.Attrs, empty)
+	if noMP && update.Attrs != nil {
+		if mp.reachAFI != 0 {
+			update.Attrs.Types = append(update.Attrs.Types, pbbgp.BGPUpdate_Attributes_MP_REACH_NLRI)
+		}
+		if len(findRawAttrs(attrs, attrMPUnreach)) > 0 {
+			update.Attrs.Types = append(update.Attrs.Types, pbbgp.BGPUpdate_Attributes_MP_UNREACH_NLRI)
+		}
+		// The NEXT_HOP attribute is kept as the next hop if there
+		// is one, like protoparse does with IPv4 MP_REACH_NLRI
+		if update.Attrs.NextHop == nil && mp.nextHop != nil {
+			update.Attrs.NextHop = ipWrapper(mp.nextHop)
+			update.Attrs.Types = append(update.Attrs.Types, pbbgp.BGPUpdate_Attributes_NEXT_HOP)
+		}
+	}
+
+	// Like protoparse, MP prefixes come before the classic ones in the
+	// advertised routes, and after them in the withdrawn routes
+	setPrefixes(update, append(mp.reach, readPrefixes(nlri, afiIPv4, ids)...), append(readPrefixes(wdr, afiIPv4, ids), mp.unreach...))
+
+	if addPath {
+		return &mrt.MrtBufferStack{MrthBuf: mrth, Bgp4mpbuf: bgp4h, Bgphbuf: bgph, Bgpupbuf: &addPathUpdate{bgpup, ids}}, nil
+	}
+	return &mrt.MrtBufferStack{MrthBuf: mrth, Bgp4mpbuf: bgp4h, Bgphbuf: bgph, Bgpupbuf: bgpup}, nil
+}
+
+// The prefixes in the MP attributes of an update. reachAFI is 0 if
+// the update has no MP_REACH_NLRI
+type mpPrefixes struct {
+	reachAFI int
+	nextHop  net.IP // the global next hop of MP_REACH_NLRI
+	reach    []*pbcom.PrefixWrapper
+	unreach  []*pbcom.PrefixWrapper
+}
+
+// Reads the MP_REACH_NLRI and MP_UNREACH_NLRI in a raw path attribute
+// block. Only unicast and multicast NLRI are read, other SAFIs like
+// labeled or VPN routes have a different encoding. If ids is not nil,
+// the prefixes have path IDs, which are added to it.
+func parseMPAttrs(block []byte, ids pathIDs) mpPrefixes {
+	var mp mpPrefixes
+	for _, val := range findRawAttrs(block, attrMPReach) {
+		// AFI, SAFI, next hop length, next hop, reserved byte
+		if len(val) < 4 || len(val) < 5+int(val[3]) {
+			continue
+		}
+		afi := int(binary.BigEndian.Uint16(val[:2]))
+		mp.reachAFI = afi
+		// An IPv6 next hop may be followed by a link-local one
+		switch nh := val[4 : 4+int(val[3])]; {
+		case len(nh) == 4:
+			mp.nextHop = net.IP(nh)
+		case len(nh) >= 16:
+			mp.nextHop = net.IP(nh[:16])
+		}
+		if isUnicastSAFI(val[2]) {
+			mp.reach = append(mp.reach, readPrefixes(val[5+int(val[3]):], afi, ids)...)
+		}
+	}
+	for _, val := range findRawAttrs(block, attrMPUnreach) {
+		// AFI, SAFI
+		if len(val) < 3 {
+			continue
+		}
+		afi := int(binary.BigEndian.Uint16(val[:2]))
+		if isUnicastSAFI(val[2]) {
+			mp.unreach = append(mp.unreach, readPrefixes(val[3:], afi, ids)...)
+		}
+	}
+	return mp
+}
+
+// Returns a copy of a 4 or 16 byte IP address in a wrapper
+func ipWrapper(ip net.IP) *pbcom.IPAddressWrapper {
+	if len(ip) == net.IPv4len {
+		return &pbcom.IPAddressWrapper{IPv4: append([]byte(nil), ip...)}
+	}
+	return &pbcom.IPAddressWrapper{IPv6: append([]byte(nil), ip...)}
+}
+
+func isUnicastSAFI(safi uint8) bool {
+	return safi == 1 || safi == 2
+}
+
+// Reads a list of prefixes of the given family. Reading stops at the
+// first malformed prefix. If ids is not nil, every prefix has a path
+// ID before it, which is added to ids
+func readPrefixes(buf []byte, afi int, ids pathIDs) []*pbcom.PrefixWrapper {
+	addrLen := 4
+	switch afi {
+	case afiIPv4:
+	case afiIPv6:
+		addrLen = 16
+	default:
+		return nil
+	}
+
+	var prefixes []*pbcom.PrefixWrapper
+	for len(buf) > 0 {
+		var id uint32
+		if ids != nil {
+			if len(buf) < 5 {
+				break
+			}
+			id = binary.BigEndian.Uint32(buf[:4])
+			buf = buf[4:]
+		}
+		bits := int(buf[0])
+		plen := (bits + 7) / 8
+		if bits > addrLen*8 || len(buf) < 1+plen {
+			break
+		}
+		ip := make([]byte, addrLen)
+		copy(ip, buf[1:1+plen])
+		// Clear the bits past the prefix length
+		if bits%8 != 0 {
+			ip[plen-1] &= 0xff << uint(8-bits%8)
+		}
+		addr := new(pbcom.IPAddressWrapper)
+		if afi == afiIPv6 {
+			addr.IPv6 = ip
+		} else {
+			addr.IPv4 = ip
+		}
+		pref := &pbcom.PrefixWrapper{Prefix: addr, Mask: uint32(bits)}
+		if ids != nil {
+			ids[pref] = id
+		}
+		prefixes = append(prefixes, pref)
+		buf = buf[1+plen:]
+	}
+	return prefixes
+}
+
+// Returns a raw path attribute block without the attributes of the
+// given type codes
+func removeRawAttrs(block []byte, codes ...uint8) []byte {
+	var kept []byte
+	walkRawAttrs(block, func(typ uint8, _, attr []byte) {
+		for _, code := range codes {
+			if typ == code {
+				return
+			}
+		}
+		kept = append(kept, attr...)
+	})
+	return kept
+}
+
+// Returns the type codes of the attributes without a value, like
+// ATOMIC_AGGREGATE. protoparse stops reading attributes at the first
+// of them, so the attributes after it would be lost
+func emptyRawAttrs(block []byte) []uint8 {
+	var codes []uint8
+	walkRawAttrs(block, func(typ uint8, val, _ []byte) {
+		if len(val) == 0 {
+			codes = append(codes, typ)
+		}
+	})
+	return codes
+}
+
+// Adds the attributes without a value, which were removed before
+// parsing, to the parsed attributes
+func addEmptyAttrs(attrs *pbbgp.BGPUpdate_Attributes, codes []uint8) *pbbgp.BGPUpdate_Attributes {
+	if len(codes) == 0 {
+		return attrs
+	}
+	if attrs == nil {
+		attrs = &pbbgp.BGPUpdate_Attributes{}
+	}
+	for _, code := range codes {
+		typ := pbbgp.BGPUpdate_Attributes_Type(code)
+		if typ == pbbgp.BGPUpdate_Attributes_ATOMIC_AGGREGATE {
+			attrs.AtomicAggregate = true
+		}
+		attrs.Types = append(attrs.Types, typ)
+	}
+	return attrs
+}
+
+// Returns the body of an update message, without the BGP header
+func buildUpdate(withdrawn, attrs, nlri []byte) []byte {
+	body := make([]byte, 0, 4+len(withdrawn)+len(attrs)+len(nlri))
+	body = append(body, byte(len(withdrawn)>>8), byte(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+	body = append(body, attrs...)
+	return append(body, nlri...)
+}
+
+// Replaces the advertised and withdrawn routes of an update. Empty
+// lists are left nil, like protoparse does
+func setPrefixes(update *pbbgp.BGPUpdate, adv, wdr []*pbcom.PrefixWrapper) {
+	update.AdvertisedRoutes = nil
+	if len(adv) > 0 {
+		update.AdvertisedRoutes = &pbbgp.BGPUpdate_AdvertisedRoutes{Prefixes: adv}
+	}
+	update.WithdrawnRoutes = nil
+	if len(wdr) > 0 {
+		update.WithdrawnRoutes = &pbbgp.BGPUpdate_WithdrawnRoutes{Prefixes: wdr}
+	}
+}
+
+// Removes the prefixes of other address families from a message.
+// Returns false if no prefix of the family is left, in which case the
+// message should be dropped. State changes, OPEN, NOTIFICATION and
+// KEEPALIVE messages are kept if their session is of the family. RIB
+// messages are never changed, since all their entries have the same
+// prefix.
+func keepAFI(mbs *mrt.MrtBufferStack, afi int) bool {
+	// Messages that never have prefixes belong to the family of
+	// their BGP session
+	if getMsgClass(mbs)&(msgUpdates|MsgRIB) == 0 {
+		b4h, ok := mbs.Bgp4mpbuf.(pp.BGP4MPHeaderer)
+		return ok && b4h.GetHeader() != nil && int(b4h.GetHeader().AddressFamily) == afi
+	}
+	if mbs.IsRibStack() {
+		for _, pref := range getMsgPrefixes(mbs, filter.AdvPrefix) {
+			return prefixAFI(pref.IP) == afi
+		}
+		return false
+	}
+
+	upd, ok := mbs.Bgpupbuf.(pp.BGPUpdater)
+	if !ok || upd.GetUpdate() == nil {
+		return false
+	}
+	update := upd.GetUpdate()
+	var adv, wdr []*pbcom.PrefixWrapper
+	if update.AdvertisedRoutes != nil {
+		adv = prefixesOfAFI(update.AdvertisedRoutes.Prefixes, afi)
+	}
+	if update.WithdrawnRoutes != nil {
+		wdr = prefixesOfAFI(update.WithdrawnRoutes.Prefixes, afi)
+	}
+	setPrefixes(update, adv, wdr)
+	return len(adv) > 0 || len(wdr) > 0
+}
+
+func prefixesOfAFI(prefixes []*pbcom.PrefixWrapper, afi int) []*pbcom.PrefixWrapper {
+	var kept []*pbcom.PrefixWrapper
+	for _, pref := range prefixes {
+		if prefixAFI(prefixRoute(pref).IP) == afi {
+			kept = append(kept, pref)
+		}
+	}
+	return kept
+}
+
+func prefixAFI(ip net.IP) int {
+	if len(ip) == 0 {
+		return afiAny
+	}
+	if ip.To4() != nil {
+		return afiIPv4
+	}
+	return afiIPv6
+}
@@ -0,0 +1,268 @@
+// Prefix filtering with match modes. Each entry of a prefix list is
+// a prefix, optionally followed by a mode or a length range:
+//	10.0.0.0/8             the default mode, orlonger unless changed
+//	10.0.0.0/8 exact       only 10.0.0.0/8 itself
+//	10.0.0.0/8 longer      prefixes inside 10.0.0.0/8, but not itself
+//	10.0.0.0/8 orshorter   10.0.0.0/8 and the prefixes that cover it
+//	10.0.0.0/8 le 24       prefixes inside 10.0.0.0/8 up to a /24
+//	10.0.0.0/8 ge 16 le 24 prefixes inside 10.0.0.0/8 from /16 to /24
+// The entries are kept in radix trees, like deleteChildPrefixes
+// does, so long lists don't slow down matching.
+
+package gobgpdump
+
+import (
+	"fmt"
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+	radix "github.com/armon/go-radix"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type PrefixMode int
+
+const (
+	PrefixOrLonger  = PrefixMode(iota) // the listed prefix and everything inside it
+	PrefixExact                        // only the listed prefix
+	PrefixLonger                       // everything inside the listed prefix
+	PrefixOrShorter                    // the listed prefix and everything that covers it
+	PrefixShorter                      // everything that covers the listed prefix
+)
+
+var prefixModes = map[string]PrefixMode{
+	"orlonger":  PrefixOrLonger,
+	"exact":     PrefixExact,
+	"longer":    PrefixLonger,
+	"orshorter": PrefixOrShorter,
+	"shorter":   PrefixShorter,
+}
+
+// An empty string is the default mode, orlonger, which is how
+// prefixes were always matched
+func parsePrefixMode(str string) (PrefixMode, error) {
+	if str == "" {
+		return PrefixOrLonger, nil
+	}
+	mode, ok := prefixModes[strings.ToLower(str)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown prefix mode: %s", str)
+	}
+	return mode, nil
+}
+
+// A message prefix matches a rule if its length is in the range.
+// Whether it must be inside the listed prefix or around it depends
+// on the tree the rule is in
+type prefixRule struct {
+	minLen int
+	maxLen int
+}
+
+// Passes messages with a prefix that matches any entry of the list,
+// in the location given by loc (filter.AdvPrefix, WdrPrefix or
+// AnyPrefix).
+type prefixFilter struct {
+	loc    int
+	inside *radix.Tree // rules for prefixes inside the listed ones
+	around *radix.Tree // rules for prefixes that cover the listed ones
+}
+
+// Returns a filter on a comma separated list of prefix entries.
+// Entries without a mode or range use mode.
+func newPrefixFilter(list string, loc int, mode PrefixMode) (filter.Filter, error) {
+	return newPrefixFilterFromSlice(strings.Split(list, ","), loc, mode)
+}
+
+func newPrefixFilterFromSlice(entries []string, loc int, mode PrefixMode) (filter.Filter, error) {
+	pf, err := newPrefixMatcher(entries, loc, mode)
+	if err != nil {
+		return nil, err
+	}
+	return pf.filter, nil
+}
+
+// Returns the prefixFilter itself, for callers that match single
+// prefixes rather than messages
+func newPrefixMatcher(entries []string, loc int, mode PrefixMode) (prefixFilter, error) {
+	pf := prefixFilter{loc: loc, inside: radix.New(), around: radix.New()}
+	for _, ent := range entries {
+		if err := pf.addEntry(ent, mode); err != nil {
+			return pf, err
+		}
+	}
+	return pf, nil
+}
+
+func (pf prefixFilter) addEntry(ent string, mode PrefixMode) error {
+	fields := strings.Fields(ent)
+	if len(fields) == 0 {
+		return fmt.Errorf("Empty prefix in list")
+	}
+	ip, ipnet, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return fmt.Errorf("Malformed prefix: %s", fields[0])
+	}
+	plen, bits := ipnet.Mask.Size()
+	key := prefixKey(ip, uint8(plen))
+
+	rule, tree := prefixRule{}, pf.inside
+	switch {
+	case len(fields) == 1 || len(fields) == 2:
+		if len(fields) == 2 {
+			if mode, err = parsePrefixMode(fields[1]); err != nil {
+				return err
+			}
+		}
+		switch mode {
+		case PrefixOrLonger:
+			rule = prefixRule{plen, bits}
+		case PrefixExact:
+			rule = prefixRule{plen, plen}
+		case PrefixLonger:
+			rule = prefixRule{plen + 1, bits}
+		case PrefixOrShorter:
+			rule, tree = prefixRule{0, plen}, pf.around
+		case PrefixShorter:
+			rule, tree = prefixRule{0, plen - 1}, pf.around
+		}
+	default:
+		if rule, err = parsePrefixRange(fields[1:], plen, bits); err != nil {
+			return fmt.Errorf("Malformed prefix entry %s: %s", ent, err)
+		}
+	}
+
+	var rules []prefixRule
+	if v, ok := tree.Get(key); ok {
+		rules = v.([]prefixRule)
+	}
+	tree.Insert(key, append(rules, rule))
+	return nil
+}
+
+// Parses "ge N", "le N" or both into a range of lengths inside a
+// prefix of length plen. Like in router prefix lists, a missing ge is
+// the length of the prefix and a missing le is the full address length
+func parsePrefixRange(fields []string, plen, bits int) (prefixRule, error) {
+	rule := prefixRule{plen, bits}
+	if len(fields) != 2 && len(fields) != 4 {
+		return rule, fmt.Errorf("expected ge and/or le with a length")
+	}
+	for i := 0; i < len(fields); i += 2 {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return rule, fmt.Errorf("malformed length %s", fields[i+1])
+		}
+		switch strings.ToLower(fields[i]) {
+		case "ge":
+			rule.minLen = n
+		case "le":
+			rule.maxLen = n
+		default:
+			return rule, fmt.Errorf("expected ge or le, got %s", fields[i])
+		}
+	}
+	if rule.minLen < plen || rule.minLen > rule.maxLen || rule.maxLen > bits {
+		return rule, fmt.Errorf("length range must be within /%d to /%d", plen, bits)
+	}
+	return rule, nil
+}
+
+// Radix keys for both address families share one tree, so each key
+// starts with the family to keep them apart
+func prefixKey(ip net.IP, mask uint8) string {
+	if len(ip) == 0 {
+		return ""
+	}
+	fam := "6"
+	if ip.To4() != nil {
+		fam = "4"
+		ip = ip.To4()
+	}
+	bits := util.IPToRadixkey(ip, mask)
+	if bits == "" && mask != 0 {
+		return ""
+	}
+	return fam + bits
+}
+
+func (pf prefixFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	for _, pref := range getMsgPrefixes(mbs, pf.loc) {
+		if pf.matches(pref.IP, pref.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pf prefixFilter) matches(ip net.IP, mask uint8) bool {
+	key := prefixKey(ip, mask)
+	if key == "" {
+		return false
+	}
+	found := false
+	inRange := func(_ string, v interface{}) bool {
+		for _, rule := range v.([]prefixRule) {
+			if int(mask) >= rule.minLen && int(mask) <= rule.maxLen {
+				found = true
+				return true
+			}
+		}
+		return false
+	}
+	// Listed prefixes that cover the message prefix are on its
+	// path, listed prefixes inside it are below it
+	pf.inside.WalkPath(key, inRange)
+	if !found {
+		pf.around.WalkPrefix(key, inRange)
+	}
+	return found
+}
+
+// Returns the prefixes of a message in the given location. Unlike
+// mrt.GetAdvertisedPrefixes and GetWithdrawnPrefixes, this is safe
+// to use on any message.
+func getMsgPrefixes(mbs *mrt.MrtBufferStack, loc int) []mrt.Route {
+	var routes []mrt.Route
+	if mbs.IsRibStack() {
+		ribh, ok := mbs.Ribbuf.(pp.RIBHeaderer)
+		if !ok || ribh.GetHeader() == nil || loc == filter.WdrPrefix {
+			return nil
+		}
+		// Every entry of a RIB message has the same prefix
+		for _, ent := range ribh.GetHeader().RouteEntry {
+			if ent.Prefix != nil && ent.Prefix.Prefix != nil {
+				return append(routes, prefixRoute(ent.Prefix))
+			}
+		}
+		return nil
+	}
+
+	upd, ok := mbs.Bgpupbuf.(pp.BGPUpdater)
+	if !ok || upd.GetUpdate() == nil {
+		return nil
+	}
+	update := upd.GetUpdate()
+	if loc != filter.WdrPrefix && update.AdvertisedRoutes != nil {
+		for _, pref := range update.AdvertisedRoutes.Prefixes {
+			routes = append(routes, prefixRoute(pref))
+		}
+	}
+	if loc != filter.AdvPrefix && update.WithdrawnRoutes != nil {
+		for _, pref := range update.WithdrawnRoutes.Prefixes {
+			routes = append(routes, prefixRoute(pref))
+		}
+	}
+	return routes
+}
+
+func prefixRoute(pref *pbcom.PrefixWrapper) mrt.Route {
+	if pref.Prefix == nil {
+		return mrt.Route{}
+	}
+	return mrt.Route{IP: net.IP(util.GetIP(pref.Prefix)), Mask: uint8(pref.Mask)}
+}
@@ -0,0 +1,213 @@
+// Progress reports of a running dump, written to the stat output as
+// one JSON object per line. A report has the files done out of those
+// the source has, the input read and the records parsed, with their
+// rates since the dump started, the records that passed the filters,
+// and an estimate of the time left. Input is counted in bytes as they
+// are stored, before decompression, so the estimate compares the bytes
+// read with the size of the files.
+
+package gobgpdump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A stringsource that can tell how many files it has, and their size
+type sizedSource interface {
+	size() (files int, bytes int64)
+}
+
+type progressReport struct {
+	Time          time.Time `json:"time"`
+	Elapsed       string    `json:"elapsed"`
+	FilesDone     int64     `json:"files_done"`
+	FilesTotal    int       `json:"files_total"`
+	Bytes         int64     `json:"bytes"`
+	BytesTotal    int64     `json:"bytes_total"`
+	BytesPerSec   int64     `json:"bytes_per_sec"`
+	Records       int64     `json:"records"`
+	RecordsPerSec int64     `json:"records_per_sec"`
+	Passed        int64     `json:"passed"`
+	ETA           string    `json:"eta,omitempty"`
+}
+
+// Counts the progress of a dump, and writes the reports. The progress
+// of a dump without reports is nil, and its methods do nothing
+type progress struct {
+	// These are updated by the workers, and only used atomically
+	bytes     int64
+	skipped   int64 // the size of files done before a resumed dump
+	records   int64
+	passed    int64
+	filesDone int64
+
+	every  time.Duration
+	source stringsource
+	stat   *MultiWriteFile
+	start  time.Time
+	done   chan struct{}
+	ended  chan struct{}
+
+	// These are only used by the reporting goroutine
+	filesTotal int
+	bytesTotal int64
+}
+
+func newProgress(every string, source stringsource, stat *MultiWriteFile) (*progress, error) {
+	d, err := time.ParseDuration(every)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("Error parsing progress interval: %s", every)
+	}
+	return &progress{every: d, source: source, stat: stat}, nil
+}
+
+// Starts writing reports, until stop is called
+func (p *progress) run() {
+	if p == nil {
+		return
+	}
+	p.start = time.Now()
+	p.done = make(chan struct{})
+	p.ended = make(chan struct{})
+	go func() {
+		defer close(p.ended)
+		// Listing every directory of a -conf dump can take a while,
+		// so it isn't done before the workers start
+		if ss, ok := p.source.(sizedSource); ok {
+			p.filesTotal, p.bytesTotal = ss.size()
+		}
+		ticker := time.NewTicker(p.every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				p.report()
+				return
+			}
+		}
+	}()
+}
+
+// Writes the last report, once every worker is done
+func (p *progress) stop() {
+	if p == nil || p.done == nil {
+		return
+	}
+	close(p.done)
+	<-p.ended
+}
+
+func (p *progress) report() {
+	elapsed := time.Since(p.start)
+	r := progressReport{
+		Time:       time.Now(),
+		Elapsed:    elapsed.Round(time.Second).String(),
+		FilesDone:  atomic.LoadInt64(&p.filesDone),
+		FilesTotal: p.filesTotal,
+		Bytes:      atomic.LoadInt64(&p.bytes),
+		BytesTotal: p.bytesTotal,
+		Records:    atomic.LoadInt64(&p.records),
+		Passed:     atomic.LoadInt64(&p.passed),
+	}
+	var byteRate float64
+	if secs := elapsed.Seconds(); secs > 0 {
+		byteRate = float64(r.Bytes) / secs
+		r.BytesPerSec = int64(byteRate)
+		r.RecordsPerSec = int64(float64(r.Records) / secs)
+	}
+	// The files left are read at the average rate so far
+	left := r.BytesTotal - r.Bytes - atomic.LoadInt64(&p.skipped)
+	if r.BytesTotal > 0 && byteRate > 0 && left > 0 {
+		eta := time.Duration(float64(left) / byteRate * float64(time.Second))
+		r.ETA = eta.Round(time.Second).String()
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	p.stat.WriteString(string(line) + "\n")
+}
+
+// Counts the bytes read from r
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReader{r, &p.bytes}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+func (p *progress) addRecord(passed bool) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.records, 1)
+	if passed {
+		atomic.AddInt64(&p.passed, 1)
+	}
+}
+
+// Counts a file as done, unless ctx stopped it
+func (p *progress) endFile(ctx context.Context) {
+	if p == nil || ctx.Err() != nil {
+		return
+	}
+	atomic.AddInt64(&p.filesDone, 1)
+}
+
+// Counts a file done before a resumed dump, which isn't read
+func (p *progress) skipFile(name string) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.filesDone, 1)
+	if fi, err := os.Stat(name); err == nil {
+		atomic.AddInt64(&p.skipped, fi.Size())
+	}
+}
+
+func (sa *StringArray) size() (files int, bytes int64) {
+	for _, name := range sa.base {
+		if fi, err := os.Stat(name); err == nil {
+			bytes += fi.Size()
+		}
+	}
+	return len(sa.base), bytes
+}
+
+// Lists every directory apart from Next. Directories that can't be
+// read are left out
+func (ds *DirectorySource) size() (files int, bytes int64) {
+	for _, dir := range ds.dirList {
+		dirFd, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		list, _ := dirFd.Readdir(0)
+		dirFd.Close()
+		for _, fi := range list {
+			bytes += fi.Size()
+		}
+		files += len(list)
+	}
+	return files, bytes
+}
@@ -0,0 +1,367 @@
+// Helpers for RIB messages: TABLE_DUMP_V2, and the legacy TABLE_DUMP
+// of older archives, which protoparse doesn't parse.
+
+package gobgpdump
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	pbcom "github.com/CSUNetSec/netsec-protobufs/common"
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	"github.com/CSUNetSec/protoparse/protocol/bgp"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	"github.com/CSUNetSec/protoparse/util"
+)
+
+// protoparse keeps the PEER_INDEX_TABLE of a RIB entry private, so
+// dumpFile wraps every RIB entry with the index table it refers to.
+// Filters and formatters use this to find the peer of each entry.
+// Once splitRib has split the message, entry holds the only entry
+// left, which was at pos in the message. ADD-PATH messages have the
+// path ID of each entry, which protoparse doesn't read. The raw index
+// table is kept for the MRT writer.
+type indexedRib struct {
+	pp.RIBHeaderer
+	peers   []*pbbgp.PeerEntry
+	entry   *pbbgp.RIB
+	pos     int
+	pathIDs []uint32
+	index   []byte
+}
+
+// Wraps rib with the peers in index, its raw record rawIndex, and the
+// path IDs of its entries if it has any. If rib is not a RIB message,
+// it is returned as it is
+func newIndexedRib(rib, index pp.PbVal, rawIndex []byte, pathIDs []uint32) pp.PbVal {
+	ribh, ok := rib.(pp.RIBHeaderer)
+	if !ok {
+		return rib
+	}
+	ir := &indexedRib{RIBHeaderer: ribh, pathIDs: pathIDs, index: rawIndex}
+	if indh, ok := index.(pp.RIBHeaderer); ok && indh.GetHeader() != nil {
+		ir.peers = indh.GetHeader().PeerEntry
+	}
+	return ir
+}
+
+// Returns the peer that the entry was received from, or nil if
+// the index table doesn't have it
+func (ir *indexedRib) peer(ent *pbbgp.RIBEntry) *pbbgp.PeerEntry {
+	if ent == nil || int(ent.PeerIndex) >= len(ir.peers) {
+		return nil
+	}
+	return ir.peers[ent.PeerIndex]
+}
+
+// Returns the path ID of the entry of a split message. ok is false
+// if the message is not an ADD-PATH message
+func (ir *indexedRib) pathID() (id uint32, ok bool) {
+	if ir.pos >= len(ir.pathIDs) {
+		return 0, false
+	}
+	return ir.pathIDs[ir.pos], true
+}
+
+// Returns the single entry of a split message, or every entry of
+// the wrapped message otherwise
+func (ir *indexedRib) GetHeader() *pbbgp.RIB {
+	if ir.entry != nil {
+		return ir.entry
+	}
+	return ir.RIBHeaderer.GetHeader()
+}
+
+// A split message is written like an entry of protoparse's text,
+// without the entry count
+func (ir *indexedRib) String() string {
+	if ir.entry == nil {
+		return ir.RIBHeaderer.String()
+	}
+	ent := ir.entry.RouteEntry[0]
+	str := ""
+	if ent.Prefix != nil {
+		str += fmt.Sprintf("PREFIX: %s\n", prefixRoute(ent.Prefix))
+	}
+	if peer := ir.peer(ent); peer != nil {
+		str += fmt.Sprintf("FROM: %s AS%d\n", net.IP(util.GetIP(peer.Peer_IP)), peer.Peer_AS)
+	}
+	if id, ok := ir.pathID(); ok {
+		str += fmt.Sprintf("PATH ID: %d\n", id)
+	}
+	str += fmt.Sprintf("ORIGINATED: %s\n", time.Unix(int64(ent.Timestamp), 0))
+	return str + bgp.AttrToString(ent.Attrs) + "\n"
+}
+
+// The same fields as protoparse's RIB JSON, which a split message
+// has one event of, and the path ID of ADD-PATH entries
+type ribEventJSON struct {
+	Peer       *ribPeerJSON
+	PathID     *uint32 `json:",omitempty"`
+	Originated time.Time
+	Attrs      *bgp.AttrsWrapper
+}
+
+type ribPeerJSON struct {
+	*pbbgp.PeerEntry
+	Peer_IP net.IP `json:"peer_IP"`
+}
+
+// The wrapped message is marshalled as if it weren't wrapped
+func (ir *indexedRib) MarshalJSON() ([]byte, error) {
+	if ir.entry == nil {
+		return json.Marshal(ir.RIBHeaderer)
+	}
+	ent := ir.entry.RouteEntry[0]
+	ev := &ribEventJSON{Originated: time.Unix(int64(ent.Timestamp), 0)}
+	if peer := ir.peer(ent); peer != nil {
+		ev.Peer = &ribPeerJSON{peer, net.IP(util.GetIP(peer.Peer_IP))}
+	}
+	if id, ok := ir.pathID(); ok {
+		ev.PathID = &id
+	}
+	if ent.Attrs != nil {
+		ev.Attrs = bgp.NewAttrsWrapper(ent.Attrs)
+	}
+	var pref *bgp.PrefixWrapper
+	if ent.Prefix != nil {
+		pref = bgp.NewPrefixWrapper(ent.Prefix)
+	}
+	return json.Marshal(struct {
+		Prefix *bgp.PrefixWrapper
+		Events []*ribEventJSON
+	}{pref, []*ribEventJSON{ev}})
+}
+
+// Splits a RIB message into a message for each of its entries, so
+// every (prefix, peer) pair is filtered and formatted on its own.
+// Other messages are returned as they are.
+func splitRib(mbs *mrt.MrtBufferStack) []*mrt.MrtBufferStack {
+	ir, ok := mbs.Ribbuf.(*indexedRib)
+	if !ok || ir.GetHeader() == nil {
+		return []*mrt.MrtBufferStack{mbs}
+	}
+	rib := ir.GetHeader()
+	split := make([]*mrt.MrtBufferStack, len(rib.RouteEntry))
+	for i, ent := range rib.RouteEntry {
+		entry := &pbbgp.RIB{PeerEntry: rib.PeerEntry, RouteEntry: []*pbbgp.RIBEntry{ent}}
+		split[i] = &mrt.MrtBufferStack{
+			MrthBuf: mbs.MrthBuf,
+			Ribbuf:  &indexedRib{RIBHeaderer: ir.RIBHeaderer, peers: ir.peers, entry: entry, pos: i, pathIDs: ir.pathIDs, index: ir.index},
+		}
+	}
+	return split
+}
+
+// Returns the raw MRT record of a message. A split RIB message is
+// rebuilt as a record with only its own entry.
+func rawRecord(mbs *mrt.MrtBufferStack) []byte {
+	raw := mbs.GetRawMessage()
+	ir, ok := mbs.Ribbuf.(*indexedRib)
+	if !ok || ir.entry == nil || len(raw) < mrt.MRT_HEADER_LEN ||
+		binary.BigEndian.Uint16(raw[4:6]) != mrt.TABLE_DUMP_V2 {
+		return raw
+	}
+	subtype := binary.BigEndian.Uint16(raw[6:8])
+	head, entries := ribEntries(raw[mrt.MRT_HEADER_LEN:], subtype)
+	if ir.pos >= len(entries) {
+		return raw
+	}
+	ent := entries[ir.pos]
+
+	rec := make([]byte, 0, mrt.MRT_HEADER_LEN+len(head)+2+len(ent))
+	rec = append(rec, raw[:mrt.MRT_HEADER_LEN]...)
+	rec = append(rec, head...)
+	rec = append(rec, 0, 1)
+	rec = append(rec, ent...)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(rec)-mrt.MRT_HEADER_LEN))
+	return rec
+}
+
+// protoparse doesn't know the ADD-PATH RIB subtypes. Returns the
+// record as the subtype without ADD-PATH, and the path ID of each
+// entry, which is taken out. ok is false if the record is malformed
+func stripRibPathIDs(data []byte) (stripped []byte, ids []uint32, ok bool) {
+	body, ok := mrtBody(data)
+	if !ok {
+		return nil, nil, false
+	}
+	subtype := binary.BigEndian.Uint16(data[6:8])
+	head, entries := ribEntries(body, subtype)
+	if head == nil {
+		return nil, nil, false
+	}
+
+	stripped = make([]byte, 0, len(data))
+	stripped = append(stripped, data[:mrt.MRT_HEADER_LEN]...)
+	binary.BigEndian.PutUint16(stripped[6:8], subtype-(ribIPv4UnicastAddPath-ribIPv4Unicast))
+	stripped = append(stripped, head...)
+	stripped = append(stripped, byte(len(entries)>>8), byte(len(entries)))
+	for _, ent := range entries {
+		// Peer index and originated time come before the path ID
+		ids = append(ids, binary.BigEndian.Uint32(ent[6:10]))
+		stripped = append(stripped, ent[:6]...)
+		stripped = append(stripped, ent[10:]...)
+	}
+	binary.BigEndian.PutUint32(stripped[8:12], uint32(len(stripped)-mrt.MRT_HEADER_LEN))
+	return stripped, ids, true
+}
+
+// Returns the peers of every entry in a RIB stack. Entries
+// without a known peer are left out
+func getRibPeers(ribbuf pp.PbVal) []*pbbgp.PeerEntry {
+	ir, ok := ribbuf.(*indexedRib)
+	if !ok || ir.GetHeader() == nil {
+		return nil
+	}
+	var peers []*pbbgp.PeerEntry
+	for _, ent := range ir.GetHeader().RouteEntry {
+		if p := ir.peer(ent); p != nil {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// protoparse stops reading the attributes of a RIB entry at the first
+// one without a value, like ATOMIC_AGGREGATE. The attributes of those
+// entries are read again without them, like parseBGP4MP does for
+// updates
+func reparseRibAttrs(mbs *mrt.MrtBufferStack) {
+	ribh, ok := mbs.Ribbuf.(pp.RIBHeaderer)
+	if !ok || ribh.GetHeader() == nil {
+		return
+	}
+	blocks := getRawAttrBlocks(mbs)
+	for i, ent := range ribh.GetHeader().RouteEntry {
+		if i >= len(blocks) {
+			return
+		}
+		empty := emptyRawAttrs(blocks[i])
+		if len(empty) == 0 || ent.Prefix == nil {
+			continue
+		}
+		v6 := prefixAFI(prefixRoute(ent.Prefix).IP) == afiIPv6
+		attrs, err, _, _ := bgp.ParseAttrs(removeRawAttrs(blocks[i], empty...), true, v6)
+		if err == nil {
+			ent.Attrs = addEmptyAttrs(attrs, empty)
+		}
+	}
+}
+
+// TABLE_DUMP_V2 subtypes, with and without ADD-PATH (RFC 8050)
+const (
+	ribIPv4Unicast          = 2
+	ribIPv6Multicast        = 5
+	ribIPv4UnicastAddPath   = 8
+	ribIPv6MulticastAddPath = 11
+)
+
+// The fields of a TABLE_DUMP record. Its subtype is the address
+// family of the prefix and peer
+type tableDumpRecord struct {
+	prefix     []byte
+	mask       uint8
+	originated uint32
+	peerIP     []byte
+	peerAS     uint32
+	attrs      []byte
+}
+
+// Reads the body of a TABLE_DUMP record
+func readTableDump(body []byte, subtype uint16) (tableDumpRecord, error) {
+	var rec tableDumpRecord
+	iplen := 4
+	switch subtype {
+	case bgp.AFI_IP:
+	case bgp.AFI_IP6:
+		iplen = 16
+	default:
+		return rec, fmt.Errorf("Unsupported TABLE_DUMP subtype: %d", subtype)
+	}
+	// View and sequence number, prefix, prefix length, status,
+	// originated time, peer IP, peer AS and attribute length
+	if len(body) < 16+2*iplen {
+		return rec, fmt.Errorf("Not enough bytes to decode TABLE_DUMP entry")
+	}
+	rec.prefix = body[4 : 4+iplen]
+	rec.mask = body[4+iplen]
+	body = body[6+iplen:]
+	rec.originated = binary.BigEndian.Uint32(body[:4])
+	rec.peerIP = body[4 : 4+iplen]
+	body = body[4+iplen:]
+	rec.peerAS = uint32(binary.BigEndian.Uint16(body[:2]))
+	alen := int(binary.BigEndian.Uint16(body[2:4]))
+	if len(body[4:]) < alen {
+		return rec, fmt.Errorf("Not enough bytes to decode TABLE_DUMP attributes")
+	}
+	rec.attrs = body[4 : 4+alen]
+	return rec, nil
+}
+
+// The entry of a TABLE_DUMP record, for indexedRib to wrap
+type tableDumpEntry struct {
+	rib *pbbgp.RIB
+}
+
+func (t tableDumpEntry) Parse() (pp.PbVal, error) {
+	return nil, nil
+}
+
+func (t tableDumpEntry) String() string {
+	return t.rib.String()
+}
+
+func (t tableDumpEntry) GetHeader() *pbbgp.RIB {
+	return t.rib
+}
+
+// Parses a TABLE_DUMP record. It has a single entry with its own
+// peer, so it is wrapped like an entry split from a TABLE_DUMP_V2
+// message, with an index table of that peer. Attributes have 2 byte
+// AS numbers.
+func parseTableDump(data []byte) (*mrt.MrtBufferStack, error) {
+	mrth := mrt.NewMrtHdrBuf(data)
+	// protoparse fills in the MRT header before it refuses the type
+	mrth.Parse()
+	body, ok := mrtBody(data)
+	if !ok {
+		return nil, fmt.Errorf("Failed parsing MRT header: not enough bytes\n")
+	}
+	subtype := binary.BigEndian.Uint16(data[6:8])
+	rec, err := readTableDump(body, subtype)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing TABLE_DUMP entry: %s\n", err)
+	}
+
+	v6 := subtype == bgp.AFI_IP6
+	empty := emptyRawAttrs(rec.attrs)
+	attrs, err, _, _ := bgp.ParseAttrs(removeRawAttrs(rec.attrs, empty...), false, v6)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing TABLE_DUMP attributes: %s\n", err)
+	}
+
+	pref, peerIP := &pbcom.IPAddressWrapper{}, &pbcom.IPAddressWrapper{}
+	if v6 {
+		pref.IPv6 = append([]byte(nil), rec.prefix...)
+		peerIP.IPv6 = append([]byte(nil), rec.peerIP...)
+	} else {
+		pref.IPv4 = append([]byte(nil), rec.prefix...)
+		peerIP.IPv4 = append([]byte(nil), rec.peerIP...)
+	}
+	peer := &pbbgp.PeerEntry{Peer_IP: peerIP, Peer_AS: rec.peerAS}
+	rib := &pbbgp.RIB{
+		PeerEntry: []*pbbgp.PeerEntry{peer},
+		RouteEntry: []*pbbgp.RIBEntry{{
+			Prefix:    &pbcom.PrefixWrapper{Prefix: pref, Mask: uint32(rec.mask)},
+			Timestamp: rec.originated,
+			Attrs:     addEmptyAttrs(attrs, empty),
+		}},
+	}
+	ribbuf := &indexedRib{RIBHeaderer: tableDumpEntry{rib}, peers: rib.PeerEntry, entry: rib}
+	return &mrt.MrtBufferStack{MrthBuf: mrth, Ribbuf: ribbuf}, nil
+}
@@ -0,0 +1,298 @@
+// RPKI route origin validation (RFC 6811) against a local VRP file.
+// The file is an export of validated ROA payloads, either the JSON
+// written by rpki-client or the CSV written by Routinator. No network
+// access is needed, so historical archives can be checked against
+// any VRP export.
+
+package gobgpdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	"github.com/CSUNetSec/protoparse/filter"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+	radix "github.com/armon/go-radix"
+)
+
+type ROVState int
+
+const (
+	ROVNotFound = ROVState(iota) // no VRP covers the prefix
+	ROVValid                     // a covering VRP matches the origin and length
+	ROVInvalid                   // covering VRPs exist, but none match
+)
+
+func (s ROVState) String() string {
+	switch s {
+	case ROVValid:
+		return "valid"
+	case ROVInvalid:
+		return "invalid"
+	}
+	return "notfound"
+}
+
+func parseROVState(str string) (ROVState, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "valid":
+		return ROVValid, nil
+	case "invalid":
+		return ROVInvalid, nil
+	case "notfound", "not-found", "unknown":
+		return ROVNotFound, nil
+	}
+	return 0, fmt.Errorf("Unknown RPKI validation state: %s", str)
+}
+
+// A validated ROA payload
+type vrp struct {
+	asn       uint32
+	maxLength int
+}
+
+// ROVValidator holds a set of VRPs in a radix tree keyed by prefix
+type ROVValidator struct {
+	vrps *radix.Tree
+	num  int
+}
+
+// NewROVValidator loads a VRP file. The format is detected from
+// the first character of the file.
+func NewROVValidator(fname string) (*ROVValidator, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	v := &ROVValidator{vrps: radix.New()}
+	br := bufio.NewReader(fd)
+	head, _ := br.Peek(512)
+	if bytes.HasPrefix(bytes.TrimSpace(head), []byte("{")) {
+		err = v.loadJSON(br)
+	} else {
+		err = v.loadCSV(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading VRP file %s: %s", fname, err)
+	}
+	return v, nil
+}
+
+// rpki-client writes {"roas": [{"asn": 13335, "prefix": "1.0.0.0/24",
+// "maxLength": 24, "ta": "apnic"}, ...]}. Older versions write the
+// ASN as a string like "AS13335".
+func (v *ROVValidator) loadJSON(r io.Reader) error {
+	var export struct {
+		Roas []struct {
+			ASN       interface{} `json:"asn"`
+			Prefix    string      `json:"prefix"`
+			MaxLength int         `json:"maxLength"`
+		} `json:"roas"`
+	}
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return err
+	}
+	for _, roa := range export.Roas {
+		var asn uint32
+		switch a := roa.ASN.(type) {
+		case float64:
+			asn = uint32(a)
+		case string:
+			var err error
+			if asn, err = parseASNumber(a); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Malformed ASN in ROA for %s", roa.Prefix)
+		}
+		if err := v.add(asn, roa.Prefix, roa.MaxLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Routinator writes a header line "ASN,IP Prefix,Max Length,Trust Anchor"
+// and then a line like "AS13335,1.0.0.0/24,24,apnic" for each VRP
+func (v *ROVValidator) loadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	first := true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 3 {
+			return fmt.Errorf("line %d: expected ASN, prefix and max length", lineOf(cr))
+		}
+		asn, err := parseASNumber(strings.TrimSpace(rec[0]))
+		if err != nil {
+			if first {
+				// The header line
+				first = false
+				continue
+			}
+			return fmt.Errorf("line %d: %s", lineOf(cr), err)
+		}
+		first = false
+		maxLength, err := strconv.Atoi(strings.TrimSpace(rec[2]))
+		if err != nil {
+			return fmt.Errorf("line %d: malformed max length %s", lineOf(cr), rec[2])
+		}
+		if err := v.add(asn, strings.TrimSpace(rec[1]), maxLength); err != nil {
+			return fmt.Errorf("line %d: %s", lineOf(cr), err)
+		}
+	}
+}
+
+func lineOf(cr *csv.Reader) int {
+	line, _ := cr.FieldPos(0)
+	return line
+}
+
+func (v *ROVValidator) add(asn uint32, prefix string, maxLength int) error {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("Malformed prefix: %s", prefix)
+	}
+	plen, bits := ipnet.Mask.Size()
+	if maxLength == 0 {
+		maxLength = plen
+	}
+	if maxLength < plen || maxLength > bits {
+		return fmt.Errorf("Max length %d out of range for %s", maxLength, prefix)
+	}
+
+	key := prefixKey(ip, uint8(plen))
+	var vrps []vrp
+	if val, ok := v.vrps.Get(key); ok {
+		vrps = val.([]vrp)
+	}
+	v.vrps.Insert(key, append(vrps, vrp{asn, maxLength}))
+	v.num++
+	return nil
+}
+
+// Len returns the number of VRPs loaded
+func (v *ROVValidator) Len() int {
+	return v.num
+}
+
+// Validate returns the state of an announcement of a prefix by an
+// origin AS. An origin of 0 stands for no origin, like a path ending
+// in an AS_SET, which can never be valid. VRPs for AS 0 never match.
+func (v *ROVValidator) Validate(ip net.IP, mask uint8, origin uint32) ROVState {
+	key := prefixKey(ip, mask)
+	if key == "" {
+		return ROVNotFound
+	}
+	state := ROVNotFound
+	v.vrps.WalkPath(key, func(_ string, val interface{}) bool {
+		state = ROVInvalid
+		for _, vr := range val.([]vrp) {
+			if vr.asn != 0 && vr.asn == origin && int(mask) <= vr.maxLength {
+				state = ROVValid
+				return true
+			}
+		}
+		return false
+	})
+	return state
+}
+
+// The result of validating one announcement in a message
+type rovResult struct {
+	Prefix string `json:"prefix"`
+	Origin uint32 `json:"origin"`
+	State  string `json:"state"`
+}
+
+// Returns the origin AS of a set of attributes, or 0 if the path is
+// empty or ends in an AS_SET
+func getOriginAS(attrs *pbbgp.BGPUpdate_Attributes) uint32 {
+	if attrs == nil || len(attrs.ASPath) == 0 {
+		return 0
+	}
+	last := attrs.ASPath[len(attrs.ASPath)-1]
+	if len(last.ASSeq) == 0 {
+		return 0
+	}
+	return last.ASSeq[len(last.ASSeq)-1]
+}
+
+// Validates every announcement in a message. An update announces its
+// prefixes with one origin, a RIB message announces its prefix once
+// for each origin its entries have.
+func (v *ROVValidator) validateMsg(mbs *mrt.MrtBufferStack) []rovResult {
+	prefixes := getMsgPrefixes(mbs, filter.AdvPrefix)
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var origins []uint32
+	for _, attrs := range getAttrs(mbs) {
+		if attrs == nil {
+			continue
+		}
+		if origin := getOriginAS(attrs); !containsAS(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+
+	var results []rovResult
+	for _, pref := range prefixes {
+		for _, origin := range origins {
+			results = append(results, rovResult{
+				Prefix: fmt.Sprintf("%s/%d", pref.IP, pref.Mask),
+				Origin: origin,
+				State:  v.Validate(pref.IP, pref.Mask, origin).String(),
+			})
+		}
+	}
+	return results
+}
+
+// Passes messages with at least one announcement in one of the states
+type rovFilter struct {
+	v      *ROVValidator
+	states []string
+}
+
+// Returns a filter on a comma separated list of states, like
+// "invalid" or "invalid,notfound"
+func newROVFilter(v *ROVValidator, list string) (filter.Filter, error) {
+	rf := rovFilter{v: v}
+	for _, str := range strings.Split(list, ",") {
+		state, err := parseROVState(str)
+		if err != nil {
+			return nil, err
+		}
+		rf.states = append(rf.states, state.String())
+	}
+	return rf.filter, nil
+}
+
+func (rf rovFilter) filter(mbs *mrt.MrtBufferStack) bool {
+	for _, res := range rf.v.validateMsg(mbs) {
+		for _, state := range rf.states {
+			if res.State == state {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+// BGP4MP_ET records have a microsecond timestamp after the MRT header,
+// which protoparse skips. The time of a message is read with
+// getTimestamp, which adds the microseconds, instead of
+// mrt.GetTimestamp wherever the precision matters.
+
+package gobgpdump
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pbbgp "github.com/CSUNetSec/netsec-protobufs/protocol/bgp"
+	pp "github.com/CSUNetSec/protoparse"
+	mrt "github.com/CSUNetSec/protoparse/protocol/mrt"
+)
+
+// Returns the microseconds of a BGP4MP_ET message. ok is false for
+// other messages
+func getMicroseconds(mbs *mrt.MrtBufferStack) (usec uint32, ok bool) {
+	raw := mbs.GetRawMessage()
+	if len(raw) < mrt.MRT_HEADER_LEN+4 || binary.BigEndian.Uint16(raw[4:6]) != mrt.BGP4MP_ET {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(raw[12:16]), true
+}
+
+// Returns the time of a message, with microseconds if it has them
+func getTimestamp(mbs *mrt.MrtBufferStack) time.Time {
+	ts := mrt.GetTimestamp(mbs)
+	if usec, ok := getMicroseconds(mbs); ok {
+		ts = ts.Add(time.Duration(usec) * time.Microsecond)
+	}
+	return ts
+}
+
+// The MRT header of a BGP4MP_ET message, which is written with the
+// microseconds in its timestamp
+type etHeader struct {
+	pp.MRTHeaderer
+	ts time.Time
+}
+
+func (h etHeader) String() string {
+	hdr := h.GetHeader()
+	return fmt.Sprintf("Timestamp:%v Type:%d Subtype:%d Len:%d", h.ts.UTC(), hdr.Type, hdr.Subtype, hdr.Len)
+}
+
+func (h etHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*pbbgp.MrtHeader
+		Timestamp time.Time `json:"timestamp,omitempty"`
+	}{h.GetHeader(), h.ts.UTC()})
+}
+
+// Returns a copy of mbs with the MRT header of a BGP4MP_ET message
+// replaced by an etHeader, for the formatters to print or marshal.
+// The raw message can't be read from the copy.
+func outputStack(mbs *mrt.MrtBufferStack) *mrt.MrtBufferStack {
+	mrth, ok := mbs.MrthBuf.(pp.MRTHeaderer)
+	if _, et := getMicroseconds(mbs); !ok || !et {
+		return mbs
+	}
+	out := *mbs
+	out.MrthBuf = etHeader{mrth, getTimestamp(mbs)}
+	return &out
+}
@@ -2,13 +2,12 @@ package gobgpdump
 
 import (
 	"bufio"
-	"compress/bzip2"
+	"encoding/binary"
 	"fmt"
 	"github.com/CSUNetSec/protoparse/protocol/mrt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sync"
 )
 
@@ -57,7 +56,7 @@ func (mwf *MultiWriteFile) Close() error {
 
 func debugPrintf(format string, a ...interface{}) {
 	if DEBUG {
-		fmt.Printf(format, a)
+		fmt.Printf(format, a...)
 	}
 }
 
@@ -68,31 +67,230 @@ func debugSprintf(format string, a ...interface{}) string {
 	return ""
 }
 
-func getScanner(fd *os.File) (scanner *bufio.Scanner) {
-	if isBz2(fd.Name()) {
-		bzreader := bzip2.NewReader(fd)
-		scanner = bufio.NewScanner(bzreader)
-	} else {
-		scanner = bufio.NewScanner(fd)
+// Returns a scanner that splits r into MRT messages. r must
+// already be decompressed
+func getScanner(r io.Reader) (scanner *bufio.Scanner) {
+	scanner = bufio.NewScanner(r)
+	scanner.Split(splitMrt)
+	// The buffer grows for long messages. Starting small keeps the
+	// input from being read far ahead of the messages parsed
+	scanbuffer := make([]byte, scanBufferLen)
+	scanner.Buffer(scanbuffer, maxMRTLen)
+	return
+}
+
+// mrt.SplitMrt returns all remaining data as one token once the
+// reader has hit EOF. Decompressors return their last block along
+// with io.EOF, which would merge every record in that block, so
+// records are still split by their length until the data runs out.
+func splitMrt(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	advance, token, err = mrt.SplitMrt(data, false)
+	if advance == 0 && err == nil && atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return
+}
+
+// The MRT types gobgpdump expects to see. In resync mode, a header
+// with any other type is treated as corrupt data
+var knownMRTTypes = map[uint16]bool{
+	11:                true, // OSPFv2
+	mrt.TABLE_DUMP:    true,
+	mrt.TABLE_DUMP_V2: true,
+	mrt.BGP4MP:        true,
+	mrt.BGP4MP_ET:     true,
+	32:                true, // ISIS
+	33:                true, // ISIS_ET
+	48:                true, // OSPFv3
+	49:                true, // OSPFv3_ET
+}
+
+// The largest MRT message the scanner can hold
+const maxMRTLen = 2 << 24
+
+// The size the buffer of the scanner starts at
+const scanBufferLen = 1 << 20
+
+// A range of bytes that was skipped while looking for an MRT header
+type skippedRange struct {
+	offset int64
+	length int
+}
+
+// mrtSplitter splits MRT messages like splitMrt, but keeps track of
+// the offset of each message in the decompressed data. In resync mode,
+// data that can't be the start of an MRT message is skipped until the
+// next plausible header, and the skipped ranges are recorded.
+type mrtSplitter struct {
+	resync    bool
+	searching bool  // the last header seen was corrupt
+	offset    int64 // offset of the next byte to be split
+	start     int64 // offset of the last message returned
+	skipped   []skippedRange
+}
+
+func newMrtSplitter(resync bool) *mrtSplitter {
+	return &mrtSplitter{resync: resync}
+}
+
+func (ms *mrtSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if ms.resync {
+		if !ms.searching && len(data) >= mrt.MRT_HEADER_LEN && !plausibleMRTHeader(data) {
+			// If the length of the corrupt header leads to another
+			// plausible header, only this message is skipped
+			mrtLen := binary.BigEndian.Uint32(data[8:12])
+			next := mrt.MRT_HEADER_LEN + int(mrtLen)
+			switch {
+			case mrtLen > maxMRTLen-mrt.MRT_HEADER_LEN:
+				ms.searching = true
+			case next+mrt.MRT_HEADER_LEN <= len(data):
+				if !plausibleMRTHeader(data[next:]) {
+					ms.searching = true
+					break
+				}
+				// The scanner stops at EOF unless a token is returned,
+				// so the next message is returned along with the skip
+				skipped := ms.skip(next)
+				advance, token, err := ms.split(data[next:], atEOF)
+				return skipped + advance, token, err
+			case atEOF:
+				ms.searching = true
+			default:
+				return 0, nil, nil
+			}
+		}
+		if ms.searching {
+			return ms.search(data, atEOF)
+		}
 	}
-	scanner.Split(mrt.SplitMrt)
-	scanbuffer := make([]byte, 2<<24)
-	scanner.Buffer(scanbuffer, cap(scanbuffer))
+
+	return ms.frame(data, atEOF)
+}
+
+func (ms *mrtSplitter) frame(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	advance, token, err = splitMrt(data, atEOF)
+	if token != nil {
+		ms.start = ms.offset
+	}
+	ms.offset += int64(advance)
 	return
 }
 
+// Skips to the next header that is followed by another plausible
+// header, or by the end of the data. Headers found inside corrupt
+// data need this extra check, since any 12 bytes could look like one
+func (ms *mrtSplitter) search(data []byte, atEOF bool) (int, []byte, error) {
+	for i := 0; i+mrt.MRT_HEADER_LEN <= len(data); i++ {
+		if !plausibleMRTHeader(data[i:]) {
+			continue
+		}
+		next := i + mrt.MRT_HEADER_LEN + int(binary.BigEndian.Uint32(data[i+8:i+12]))
+		switch {
+		case next+mrt.MRT_HEADER_LEN <= len(data):
+			if !plausibleMRTHeader(data[next:]) {
+				continue
+			}
+		case atEOF:
+			if next > len(data) {
+				continue
+			}
+		default:
+			// Can't confirm this header without more data
+			return ms.skip(i), nil, nil
+		}
+		ms.searching = false
+		skipped := ms.skip(i)
+		advance, token, err := ms.frame(data[i:], atEOF)
+		return skipped + advance, token, err
+	}
+
+	if atEOF {
+		return ms.skip(len(data)), nil, nil
+	}
+	if len(data) < mrt.MRT_HEADER_LEN {
+		return 0, nil, nil
+	}
+	// The tail may be the start of a header that isn't complete yet
+	return ms.skip(len(data) - mrt.MRT_HEADER_LEN + 1), nil, nil
+}
+
+// Records n skipped bytes, and returns n
+func (ms *mrtSplitter) skip(n int) int {
+	if n == 0 {
+		return 0
+	}
+	if last := len(ms.skipped) - 1; last >= 0 && ms.skipped[last].offset+int64(ms.skipped[last].length) == ms.offset {
+		ms.skipped[last].length += n
+	} else {
+		ms.skipped = append(ms.skipped, skippedRange{ms.offset, n})
+	}
+	ms.offset += int64(n)
+	return n
+}
+
+// Returns the ranges skipped since the last call
+func (ms *mrtSplitter) takeSkipped() []skippedRange {
+	sk := ms.skipped
+	ms.skipped = nil
+	return sk
+}
+
+func plausibleMRTHeader(hdr []byte) bool {
+	mrtType := binary.BigEndian.Uint16(hdr[4:6])
+	mrtLen := binary.BigEndian.Uint32(hdr[8:12])
+	return knownMRTTypes[mrtType] && mrtLen <= maxMRTLen-mrt.MRT_HEADER_LEN
+}
+
+// Returns a scanner over the MRT messages of fd. If the compressed
+// data of fd can't be read, the scanner returns the error. The
+// decompressor is closed once the scanner reads to the end of the data
+// or to an error; a scanner that stops before that leaves it open, so
+// callers that may stop early should use GetMRTReaderScanner
 func GetMRTScanner(fd *os.File) *bufio.Scanner {
-	return getScanner(fd)
+	dr, _, err := getDecompressor(fd)
+	if err != nil {
+		return getScanner(errReader{err})
+	}
+	return getScanner(&closingReader{rc: dr})
 }
 
-func isBz2(fname string) bool {
-	fext := filepath.Ext(fname)
-	if fext == ".bz2" {
-		return true
+// Returns a scanner over MRT messages read from any reader.
+// Compressed data is detected and decompressed. The closer must be
+// closed once the scanner is done, and doesn't close r
+func GetMRTReaderScanner(r io.Reader) (*bufio.Scanner, io.Closer, error) {
+	dr, _, err := getDecompressor(r)
+	if err != nil {
+		return nil, nil, err
 	}
-	return false
+	return getScanner(dr), dr, nil
+}
+
+// Closes rc once a read from it fails, which includes io.EOF
+type closingReader struct {
+	rc     io.ReadCloser
+	closed bool
 }
 
+func (cr *closingReader) Read(p []byte) (int, error) {
+	if cr.closed {
+		return 0, io.EOF
+	}
+	n, err := cr.rc.Read(p)
+	if err != nil {
+		cr.closed = true
+		if cerr := cr.rc.Close(); err == io.EOF && cerr != nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+type errReader struct {
+	err error
+}
+
+func (er errReader) Read([]byte) (int, error) { return 0, er.err }
+
 type DiscardCloser struct{}
 
 func (d DiscardCloser) Write(data []byte) (n int, err error) { return ioutil.Discard.Write(data) }
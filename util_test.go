@@ -0,0 +1,183 @@
+package gobgpdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// Returns an MRT record of the given type with a body of n bytes
+func testRecord(mrtType uint16, n int) []byte {
+	rec := make([]byte, 12+n)
+	binary.BigEndian.PutUint32(rec[0:4], 1)
+	binary.BigEndian.PutUint16(rec[4:6], mrtType)
+	binary.BigEndian.PutUint16(rec[6:8], 4)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(n))
+	for i := 12; i < len(rec); i++ {
+		rec[i] = byte(i)
+	}
+	return rec
+}
+
+// Returns a record header with the given type and length field, and
+// no body
+func testHeader(mrtType uint16, length uint32) []byte {
+	hdr := testRecord(mrtType, 0)
+	binary.BigEndian.PutUint32(hdr[8:12], length)
+	return hdr
+}
+
+func repeatByte(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+// Reads at most n bytes at a time
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > cr.n {
+		p = p[:cr.n]
+	}
+	return cr.r.Read(p)
+}
+
+type splitToken struct {
+	offset int64
+	data   []byte
+}
+
+// Splits data read in chunks of n bytes, and returns the tokens with
+// their offsets and the skipped ranges
+func splitAll(data []byte, n int, resync bool) ([]splitToken, []skippedRange, error) {
+	scanner := bufio.NewScanner(&chunkReader{bytes.NewReader(data), n})
+	splitter := newMrtSplitter(resync)
+	scanner.Split(splitter.split)
+	var tokens []splitToken
+	var skipped []skippedRange
+	for scanner.Scan() {
+		tokens = append(tokens, splitToken{splitter.start, append([]byte(nil), scanner.Bytes()...)})
+		skipped = append(skipped, splitter.takeSkipped()...)
+	}
+	skipped = append(skipped, splitter.takeSkipped()...)
+	return tokens, skipped, scanner.Err()
+}
+
+func TestMrtSplitter(t *testing.T) {
+	rec1 := testRecord(16, 30)
+	rec2 := testRecord(13, 45)
+	rec3 := testRecord(17, 8)
+	corrupt := append(testHeader(99, 5), repeatByte(0xee, 5)...)
+	tooLong := testHeader(16, 0xffffffff)
+	garbage := repeatByte(0xff, 23)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	r1, r2 := int64(len(rec1)), int64(len(rec2))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		resync  bool
+		tokens  []splitToken
+		skipped []skippedRange
+	}{
+		{
+			name:   "records",
+			data:   join(rec1, rec2, rec3),
+			tokens: []splitToken{{0, rec1}, {r1, rec2}, {r1 + r2, rec3}},
+		},
+		{
+			name:   "records in resync mode",
+			data:   join(rec1, rec2, rec3),
+			resync: true,
+			tokens: []splitToken{{0, rec1}, {r1, rec2}, {r1 + r2, rec3}},
+		},
+		{
+			name:    "corrupt header with a length leading to a header",
+			data:    join(rec1, corrupt, rec2, rec3),
+			resync:  true,
+			tokens:  []splitToken{{0, rec1}, {r1 + 17, rec2}, {r1 + 17 + r2, rec3}},
+			skipped: []skippedRange{{r1, 17}},
+		},
+		{
+			name:    "corrupt last header with a length leading to the end",
+			data:    join(rec1, corrupt),
+			resync:  true,
+			tokens:  []splitToken{{0, rec1}},
+			skipped: []skippedRange{{r1, 17}},
+		},
+		{
+			name:    "corrupt length forcing a search",
+			data:    join(rec1, tooLong, garbage, rec2, rec3),
+			resync:  true,
+			tokens:  []splitToken{{0, rec1}, {r1 + 35, rec2}, {r1 + 35 + r2, rec3}},
+			skipped: []skippedRange{{r1, 35}},
+		},
+		{
+			name:    "garbage at the end",
+			data:    join(rec1, rec2, garbage),
+			resync:  true,
+			tokens:  []splitToken{{0, rec1}, {r1, rec2}},
+			skipped: []skippedRange{{r1 + r2, 23}},
+		},
+		{
+			name:    "garbage at the start",
+			data:    join(garbage, rec1, rec2),
+			resync:  true,
+			tokens:  []splitToken{{23, rec1}, {23 + r1, rec2}},
+			skipped: []skippedRange{{0, 23}},
+		},
+	}
+
+	// A chunk size of 1 splits every header across reads
+	for _, n := range []int{1, 5, 13, 4096} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s/reads of %d", test.name, n), func(t *testing.T) {
+				tokens, skipped, err := splitAll(test.data, n, test.resync)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !reflect.DeepEqual(tokens, test.tokens) {
+					t.Errorf("tokens:\n got %v\nwant %v", tokens, test.tokens)
+				}
+				if !reflect.DeepEqual(skipped, test.skipped) {
+					t.Errorf("skipped: got %v, want %v", skipped, test.skipped)
+				}
+			})
+		}
+	}
+}
+
+type testReadCloser struct {
+	io.Reader
+	closed int
+}
+
+func (rc *testReadCloser) Close() error {
+	rc.closed++
+	return nil
+}
+
+func TestClosingReader(t *testing.T) {
+	data := bytes.Repeat(testRecord(16, 20), 3)
+	rc := &testReadCloser{Reader: bytes.NewReader(data)}
+	scanner := getScanner(&closingReader{rc: rc})
+	n := 0
+	for scanner.Scan() {
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 3 || rc.closed != 1 {
+		t.Errorf("got %d records and %d closes, want 3 and 1", n, rc.closed)
+	}
+}